@@ -0,0 +1,114 @@
+// Command dnsctl inspects a running DNS server through its control address,
+// set with the server's -control flag
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/dns-server-starter-go/app/server"
+)
+
+// How long a single request to the control address may take
+const requestTimeout = 5 * time.Second
+
+func main() {
+	control := flag.String("control", "127.0.0.1:2953", "control `address` of the server, as given to its -control flag")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: dnsctl [-control address] command [flags]\n\nCommands:\n  top    show the top clients, domains, blocked domains and NXDOMAIN sources\n  types  show how many queries were received for each type\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "top":
+		os.Exit(runTop(*control, flag.Args()[1:]))
+	case "types":
+		os.Exit(runTypes(*control))
+	case "":
+		flag.Usage()
+	default:
+		fmt.Printf("Unknown command %q\n", flag.Arg(0))
+	}
+	os.Exit(2)
+}
+
+// runTop shows the top talkers report, refreshed until interrupted. Returns
+// the process exit code
+func runTop(control string, args []string) int {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	n := flags.Int("n", 10, "show the top `n` entries of each kind")
+	interval := flags.Duration("interval", 2*time.Second, "how often to refresh")
+	once := flags.Bool("once", false, "print the report once and exit")
+	flags.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	url := fmt.Sprintf("http://%s/top?n=%d", control, *n)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		var report server.TopReport
+		err := fetch(ctx, url, &report)
+		if ctx.Err() != nil {
+			return 0
+		}
+		if err != nil {
+			fmt.Println("Failed to fetch top talkers:", err)
+			return 1
+		}
+		if *once {
+			fmt.Print(report)
+			return 0
+		}
+		// Redraw in place, like top(1)
+		fmt.Printf("\033[H\033[2J%s\n%s, refreshing every %s\n", report, control, *interval)
+
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+// runTypes prints the per-type query counters. Returns the process exit code
+func runTypes(control string) int {
+	var report server.TypeReport
+	if err := fetch(context.Background(), fmt.Sprintf("http://%s/types", control), &report); err != nil {
+		fmt.Println("Failed to fetch query types:", err)
+		return 1
+	}
+	fmt.Print(report)
+	return 0
+}
+
+// fetch requests url from the control address and decodes its JSON reply
+// into v
+func fetch(ctx context.Context, url string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control answered %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
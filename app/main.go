@@ -1,28 +1,297 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codecrafters-io/dns-server-starter-go/app/server"
 )
 
-// Ensures gofmt doesn't remove the "net" import in stage 1 (feel free to remove this!)
-var _ = net.ListenUDP
+// How long in-flight queries get to finish once a shutdown signal arrives
+const shutdownTimeout = 5 * time.Second
+
+// TTL in seconds of the records set with -record
+const recordTTL = 300
+
+// recordKey groups the -record flags into one override per name and type
+type recordKey struct {
+	name  string
+	qtype server.QuestionType
+}
 
 func main() {
 	fmt.Println("Logs from your program will appear here!")
 
-	s := server.NewDnsServer(&net.UDPAddr{
-		IP:   net.ParseIP("127.0.0.1"),
-		Port: 2053,
+	listen := flag.String("listen", "127.0.0.1:2053", "comma-separated `addresses` to listen on, e.g. 0.0.0.0:2053,[::]:2053")
+	sockets := flag.Int("reuseport", 1, "number of SO_REUSEPORT sockets to open per listen address (Linux only)")
+	resolver := flag.String("resolver", "", "forward queries to the resolvers at comma-separated `addresses`, e.g. 8.8.8.8:53,tls://1.1.1.1,https://dns.google/dns-query,quic://dns.adguard-dns.com, instead of answering them statically; the fastest healthy one is used")
+	race := flag.Int("race", 0, "send each forwarded query to the `n` fastest upstreams at once and use the first reply")
+	retries := flag.Int("retries", 1, "retry a forwarded query `n` more times over all upstreams, with jittered exponential backoff, before answering SERVFAIL")
+	attemptTimeout := flag.Duration("attempt-timeout", time.Second, "how long to wait on a single upstream before trying the next")
+	deadline := flag.Duration("deadline", 3*time.Second, "how long a forwarded query may take over all attempts before answering SERVFAIL")
+	zones := flag.String("zones", "", "comma-separated `zones` to answer authoritatively; other names get no answer")
+	refuse := flag.String("refuse-out-of-zone", "", "comma-separated listen `addresses` answering queries outside -zones with REFUSED, or * for all")
+	var delegations []server.ForwarderOption
+	flag.Func("delegate", "forward queries under a `zone=server,...` to its own name servers, each an address, a name or name@glue-address (repeatable)", func(v string) error {
+		zone, servers, ok := strings.Cut(v, "=")
+		if !ok || servers == "" {
+			return fmt.Errorf("expected zone=server,...")
+		}
+		delegations = append(delegations, server.WithDelegation(zone, strings.Split(servers, ",")...))
+		return nil
+	})
+	var routes []server.Option
+	flag.Func("route", "resolve names under a `suffix=strategy` with forward (to -resolver), recurse (from the root servers), authoritative (-record data with AA) or block (NXDOMAIN); the deepest suffix wins and . matches every name (repeatable)", func(v string) error {
+		suffix, name, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("expected suffix=strategy")
+		}
+		strategy, err := server.ParseStrategy(name)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, server.WithRoute(suffix, strategy))
+		return nil
+	})
+	records := make(map[recordKey][]*server.ResourceRecord)
+	flag.Func("record", "serve a `name=address` A or AAAA record from local data, as -hybrid and authoritative routes do for their zones (repeatable)", func(v string) error {
+		name, addr, _ := strings.Cut(v, "=")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("expected name=address")
+		}
+		rr := server.NewARecord(name, ip, recordTTL)
+		if ip.To4() == nil {
+			rr = &server.ResourceRecord{Name: name, Type: server.AAAA, Class: 1, TTL: recordTTL, Data: ip.To16()}
+		}
+		key := recordKey{server.CanonicalName(name), rr.Type}
+		records[key] = append(records[key], rr)
+		return nil
+	})
+	hybrid := flag.Bool("hybrid", false, "answer names under -zones from -record data with AA, NXDOMAIN for names without any, and resolve every other name from the root servers with RA; a -route for a zone opts it out")
+	rootHints := flag.String("root-hints", "", "comma-separated `addresses` of the root servers recursion starts from, instead of the IANA ones")
+	cacheSize := flag.Int("cache", 10000, "cache up to `n` forwarded and recursive replies for their TTL; 0 disables the cache")
+	ttlCaps := make(map[string]time.Duration)
+	flag.Func("cache-ttl-cap", "cache replies for names under a `suffix=duration` for at most that long and serve them with TTLs no higher, e.g. example-cdn.com=30s, for upstreams with misconfigured TTLs (repeatable)", func(v string) error {
+		suffix, ttl, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("expected suffix=duration")
+		}
+		limit, err := time.ParseDuration(ttl)
+		if err != nil {
+			return err
+		}
+		ttlCaps[suffix] = limit
+		return nil
 	})
+	warm := flag.String("warm", "", "comma-separated `names` whose A and AAAA answers are kept in the cache, looked up at startup and refreshed before they expire")
+	rebind := flag.Bool("rebind-protection", false, "answer NXDOMAIN when a forwarded or recursive answer points a name at a private, loopback or link-local address")
+	rebindOK := flag.String("rebind-ok", "", "comma-separated `suffixes` allowed to resolve to local addresses under -rebind-protection, e.g. for split-horizon domains")
+	var ttlFloors []server.Option
+	flag.Func("ttl-floor", "raise forwarded and recursive A/AAAA answers to clients in a group of `networks=duration` to at least that TTL, e.g. 10.20.0.0/16,fd00:20::/64=5m, to blunt fast-flux and rebinding tricks (repeatable)", func(v string) error {
+		networks, ttl, ok := strings.Cut(v, "=")
+		if !ok {
+			return fmt.Errorf("expected networks=duration")
+		}
+		floor, err := time.ParseDuration(ttl)
+		if err != nil {
+			return err
+		}
+		var clients []netip.Prefix
+		for _, n := range strings.Split(networks, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(n))
+			if err != nil {
+				return err
+			}
+			clients = append(clients, prefix)
+		}
+		ttlFloors = append(ttlFloors, server.WithTTLFloor(floor, clients...))
+		return nil
+	})
+	control := flag.String("control", "", "serve live statistics for dnsctl over HTTP on `address`, e.g. 127.0.0.1:2953; keep it private to operators")
+	tcp := flag.Bool("tcp", true, "serve DNS over TCP next to UDP on every listen address, where clients retry truncated UDP replies; -tcp=false serves UDP only")
+	replay := flag.String("replay", "", "replay the DNS queries in a pcap `file` offline and compare replies, then exit")
+	flag.Parse()
 
-	err := s.Listen()
-	if err != nil {
-		fmt.Println("Failed to listen:", err)
-		return
+	var addrs []*net.UDPAddr
+	for _, a := range strings.Split(*listen, ",") {
+		addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(a))
+		if err != nil {
+			fmt.Println("Invalid listen address:", err)
+			os.Exit(1)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	opts := []server.Option{server.WithAddrs(addrs[1:]...), server.WithReusePort(*sockets), server.WithTCP(*tcp)}
+	if *zones != "" {
+		opts = append(opts, server.WithZones(strings.Split(*zones, ",")...))
 	}
+	if *refuse == "*" {
+		opts = append(opts, server.WithRefuseOutOfZone())
+	} else if *refuse != "" {
+		var refuseAddrs []*net.UDPAddr
+		for _, a := range strings.Split(*refuse, ",") {
+			addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(a))
+			if err != nil {
+				fmt.Println("Invalid listen address:", err)
+				os.Exit(1)
+			}
+			refuseAddrs = append(refuseAddrs, addr)
+		}
+		opts = append(opts, server.WithRefuseOutOfZone(refuseAddrs...))
+	}
+	opts = append(opts, routes...)
+	for key, answers := range records {
+		opts = append(opts, server.WithOverride(server.Override{Name: key.name, Type: key.qtype, Answers: answers}))
+	}
+	if *hybrid {
+		opts = append(opts, server.WithHybrid())
+	}
+	opts = append(opts, ttlFloors...)
+	if *rootHints != "" {
+		var roots []string
+		for _, r := range strings.Split(*rootHints, ",") {
+			roots = append(roots, strings.TrimSpace(r))
+		}
+		opts = append(opts, server.WithRecursor(server.NewRecursor(roots...)))
+	}
+	if *rebind {
+		var allow []string
+		if *rebindOK != "" {
+			for _, suffix := range strings.Split(*rebindOK, ",") {
+				allow = append(allow, strings.TrimSpace(suffix))
+			}
+		}
+		opts = append(opts, server.WithRebindProtection(allow...))
+	}
+	// Replays compare fresh replies, so they go without the cache
+	var cache *server.Cache
+	if *cacheSize > 0 && *replay == "" {
+		cache = server.NewCache(*cacheSize)
+		for suffix, limit := range ttlCaps {
+			cache.CapTTL(suffix, limit)
+		}
+		opts = append(opts, server.WithCache(cache))
+	}
+	if *warm != "" && *replay == "" {
+		var names []string
+		for _, name := range strings.Split(*warm, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+		opts = append(opts, server.WithWarmNames(names...))
+	}
+	var forwarder *server.Forwarder
+	if *resolver != "" {
+		var upstreams []string
+		for _, u := range strings.Split(*resolver, ",") {
+			upstreams = append(upstreams, strings.TrimSpace(u))
+		}
+		fwdOpts := append(delegations,
+			server.WithRace(*race),
+			server.WithRetries(*retries),
+			server.WithAttemptTimeout(*attemptTimeout),
+			server.WithDeadline(*deadline),
+		)
+		f, err := server.NewForwarder(upstreams, fwdOpts...)
+		if err != nil {
+			fmt.Println("Invalid resolver:", err)
+			os.Exit(1)
+		}
+		opts = append(opts, server.WithResolver(f))
+		forwarder = f
+	}
+	s := server.NewDnsServer(addrs[0], opts...)
+
+	if *replay != "" {
+		s.Use(s.Recovery())
+		os.Exit(runReplay(s, *replay))
+	}
+	s.Use(s.Recovery(), server.Logging(), server.Metrics(s.Stats()))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Listen(context.Background())
+	}()
 	fmt.Println("Listening on", s.String())
+
+	var controlServer *http.Server
+	if *control != "" {
+		controlServer = &http.Server{Addr: *control, Handler: s.ControlHandler()}
+		go func() {
+			if err := controlServer.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Println("Failed to serve control:", err)
+			}
+		}()
+		fmt.Println("Serving control on", *control)
+	}
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			fmt.Println("Failed to listen:", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if controlServer != nil {
+		controlServer.Shutdown(shutdownCtx)
+	}
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		fmt.Println("Failed to shut down cleanly:", err)
+	}
+	if err := <-errs; err != nil {
+		fmt.Println("Failed to listen:", err)
+	}
+	if forwarder != nil {
+		fmt.Println("Upstream connections:", forwarder.PoolStats())
+	}
+	if cache != nil {
+		fmt.Println("Cache:", cache.Stats())
+	}
+}
+
+// runReplay replays a capture through s and prints the differences found.
+// Returns the process exit code: non-zero if any reply differed
+func runReplay(s *server.DNSServer, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Failed to open capture:", err)
+		return 1
+	}
+	defer f.Close()
+
+	report, err := s.Replay(f)
+	if err != nil {
+		fmt.Println("Failed to replay capture:", err)
+		return 1
+	}
+
+	for _, m := range report.Mismatches {
+		fmt.Printf("Mismatch for query %d: %s\n", m.Query.Header.ID, m.Reason)
+	}
+	fmt.Printf("Replayed %d queries: %d matched, %d differed, %d had no captured reply\n",
+		report.Queries, report.Matched, len(report.Mismatches), report.Unanswered)
+
+	if len(report.Mismatches) > 0 {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// Defences of outgoing queries against off-path spoofing (RFC 5452): an
+// attacker racing the upstream's reply has to guess the transaction ID and the
+// source port, and a forged reply must still name the right question and come
+// from the upstream's address
+
+const (
+	// udpPortMin is the lowest source port picked for outgoing UDP queries,
+	// leaving out the well-known ports
+	udpPortMin = 1024
+
+	// udpPortAttempts is how many random ports are tried before leaving the
+	// choice to the kernel, in case the picked ones are taken
+	udpPortAttempts = 8
+)
+
+// randomID returns a transaction ID from the system's secure random source,
+// so it cannot be predicted from earlier ones (RFC 5452 §9.2)
+func randomID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// dialUDP connects a UDP socket to addr from a source port picked at random
+// across the whole unprivileged range rather than the kernel's ephemeral
+// range, which is smaller and on some systems sequential (RFC 5452 §10)
+func dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	for range udpPortAttempts {
+		port := udpPortMin + int(randomID())%(0x10000-udpPortMin)
+		d := net.Dialer{LocalAddr: &net.UDPAddr{Port: port}}
+		conn, err := d.DialContext(ctx, "udp", addr)
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return conn, err
+		}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "udp", addr)
+}
+
+// fromPeer reports whether a datagram received from source came from the
+// address conn is connected to. The kernel already filters connected
+// sockets; this keeps the check explicit
+func fromPeer(conn net.Conn, source *net.UDPAddr) bool {
+	peer, ok := conn.RemoteAddr().(*net.UDPAddr)
+	return ok && peer.IP.Equal(source.IP) && peer.Port == source.Port
+}
+
+// matchesQuery reports whether raw is a reply to query: it must carry the
+// query's ID and echo its question's name, type and class. Names are compared
+// case-insensitively, as servers need not preserve case
+func matchesQuery(raw []byte, query *Message) bool {
+	header, offset, err := ParseHeader(raw)
+	if err != nil || header.ID != query.Header.ID {
+		return false
+	}
+	if len(query.Questions) == 0 {
+		return true
+	}
+	if int(header.QDCount) != len(query.Questions) {
+		return false
+	}
+
+	q := query.Questions[0]
+	echoed, _, err := ParseQuestion(raw, offset)
+	return err == nil && CanonicalName(echoed.Name) == CanonicalName(q.Name) &&
+		echoed.Type == q.Type && echoed.Class == q.Class
+}
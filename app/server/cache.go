@@ -0,0 +1,468 @@
+package server
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cacheShards is how many independently locked parts the cache is split
+	// into, so concurrent queries rarely wait on each other
+	cacheShards = 16
+
+	// maxCacheTTL caps how long any reply is cached, whatever its TTLs say
+	maxCacheTTL = 24 * time.Hour
+
+	// maxNegativeCacheTTL caps how long NXDOMAIN and NODATA replies are
+	// cached (RFC 2308 §5)
+	maxNegativeCacheTTL = 3 * time.Hour
+
+	// prefetchMinHits is how many times an entry must have been served before
+	// it is worth refreshing ahead of its expiry
+	prefetchMinHits = 3
+
+	// prefetchFraction sets when a popular entry is refreshed: in the last
+	// 1/prefetchFraction of its TTL, the last tenth as in Unbound
+	prefetchFraction = 10
+
+	// maxPrefetches bounds the refreshes running at once, so a burst of
+	// popular names expiring together cannot flood the upstreams
+	maxPrefetches = 16
+)
+
+// Cache keeps the replies to recursive queries for as long as their TTLs
+// allow, keyed by the question's name, type and class. Names are compared
+// case-insensitively. Each shard evicts its least recently used entry when
+// full, and expired entries are dropped when next looked up. Popular entries
+// are refreshed in the background shortly before they expire, so clients do
+// not wait on a lookup when they do
+type Cache struct {
+	seed   maphash.Seed
+	shards [cacheShards]cacheShard
+	// ttlCaps bound the TTL of names at or below each canonical suffix, see
+	// CapTTL
+	ttlCaps map[string]time.Duration
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	prefetches  atomic.Uint64
+	prefetching atomic.Int32
+}
+
+// cacheShard is a part of the cache with its own lock and LRU order
+type cacheShard struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[cacheKey]*list.Element
+	// lru holds *cacheEntry, most recently used first
+	lru list.List
+}
+
+// cacheKey identifies a cached reply. name is canonical. Replies keep the
+// DNSSEC records upstreams always send, which StripDNSSEC removes for clients
+// that did not set DO, so one entry serves both
+type cacheKey struct {
+	name  string
+	qtype QuestionType
+	class uint16
+}
+
+// cacheEntry is a cached reply, without its OPT record
+type cacheEntry struct {
+	key         cacheKey
+	rcode       RCode
+	answers     []*ResourceRecord
+	authorities []*ResourceRecord
+	additionals []*ResourceRecord
+	stored      time.Time
+	expires     time.Time
+	// hits counts the queries answered from the entry and prefetched is set
+	// once a refresh of it has started. Both are guarded by the shard's lock
+	hits       int
+	prefetched bool
+}
+
+// CacheStats are the counters of a Cache
+type CacheStats struct {
+	Hits       uint64 // Queries answered from the cache
+	Misses     uint64 // Queries the cache had no live reply for
+	Evictions  uint64 // Entries dropped to make room or relieve memory pressure
+	Prefetches uint64 // Popular entries refreshed before they expired
+	Entries    int    // Replies currently cached
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("%d hits, %d misses, %d evictions, %d prefetches, %d entries",
+		s.Hits, s.Misses, s.Evictions, s.Prefetches, s.Entries)
+}
+
+// NewCache builds a cache holding up to maxEntries replies
+func NewCache(maxEntries int) *Cache {
+	c := &Cache{seed: maphash.MakeSeed()}
+	for i := range c.shards {
+		c.shards[i].maxEntries = max(maxEntries/cacheShards, 1)
+		c.shards[i].entries = make(map[cacheKey]*list.Element)
+	}
+	return c
+}
+
+// CapTTL caches replies for names at or below suffix for at most max and
+// lowers the TTLs served from the cache to match, whatever the upstreams say,
+// to work around misconfigured TTLs. The deepest matching suffix wins. It
+// must be called before the cache is used
+func (c *Cache) CapTTL(suffix string, max time.Duration) {
+	if c.ttlCaps == nil {
+		c.ttlCaps = make(map[string]time.Duration)
+	}
+	c.ttlCaps[CanonicalName(suffix)] = max
+}
+
+// ttlCap returns the cap on the TTL of name, which must be canonical, from
+// its deepest suffix given to CapTTL
+func (c *Cache) ttlCap(name string) (time.Duration, bool) {
+	for {
+		if limit, ok := c.ttlCaps[name]; ok {
+			return limit, true
+		}
+		if name == "" {
+			return 0, false
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+}
+
+// WithCache answers repeated recursive queries from c, see Caching. Under
+// memory pressure (see WithMemoryLimit) the cache stops taking new replies
+// and is halved
+func WithCache(c *Cache) Option {
+	return func(s *DNSServer) {
+		s.cache = c
+	}
+}
+
+// Stats returns a snapshot of the cache's counters
+func (c *Cache) Stats() CacheStats {
+	entries := 0
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		entries += len(sh.entries)
+		sh.mu.Unlock()
+	}
+	return CacheStats{
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Evictions:  c.evictions.Load(),
+		Prefetches: c.prefetches.Load(),
+		Entries:    entries,
+	}
+}
+
+// Caching answers queries from c when it holds a live reply to their
+// question, and otherwise caches the reply the next handler sends. Only
+// replies with RA set, which come from forwarding or recursion, are cached:
+// static and authoritative answers are cheap and may change at any time.
+// Queries with more than one question, and replies to queries with CD set,
+// are never cached, as a validating upstream answers those differently.
+// Neither are replies to queries with RD unset, which only get local data.
+// Entries served at least prefetchMinHits times are looked up again through
+// the next handler when a query finds them in the last tenth of their TTL.
+// pressure, if not nil, stops new replies being cached and entries being
+// prefetched while it reports true
+func Caching(c *Cache, pressure func() bool) Middleware {
+	return caching(c, pressure, func(name string, task func()) {
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					fmt.Printf("Recovered panic in %s: %v\n%s", name, p, truncatedStack())
+				}
+			}()
+			task()
+		}()
+	})
+}
+
+// caching is Caching with the prefetches run by background, which the server
+// uses to account for them
+func caching(c *Cache, pressure func() bool, background func(name string, task func())) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			if len(r.Questions) != 1 || r.Header.Flag.GetOPCode() != QUERY {
+				next.ServeDNS(w, r)
+				return
+			}
+			key := newCacheKey(r.Questions[0])
+
+			underPressure := pressure != nil && pressure()
+			if reply, stale, ok := c.lookup(key, r, time.Now(), !underPressure); ok {
+				if err := w.WriteMsg(reply); err != nil {
+					fmt.Printf("Failed to reply to %s: %v\n", w.RemoteAddr(), err)
+				}
+				if stale {
+					q := r.Questions[0]
+					pw := newPrefetchWriter(w)
+					background("prefetch of "+q.Name, func() {
+						c.prefetch(next, pw, key, q)
+					})
+				}
+				return
+			}
+
+			rw := &recordingWriter{ResponseWriter: w}
+			next.ServeDNS(rw, r)
+			if rw.reply != nil && !r.Header.Flag.GetCD() && r.Header.Flag.GetRD() && (pressure == nil || !pressure()) {
+				c.store(key, rw.reply, time.Now())
+			}
+		})
+	}
+}
+
+func newCacheKey(q *Question) cacheKey {
+	return cacheKey{name: CanonicalName(q.Name), qtype: q.Type, class: q.Class}
+}
+
+func (c *Cache) shard(key cacheKey) *cacheShard {
+	return &c.shards[maphash.String(c.seed, key.name)%cacheShards]
+}
+
+// lookup builds the reply to r from the entry for key if there is a live one,
+// with TTLs reduced by the time it has been cached. If prefetch is set, stale
+// reports that the caller should refresh the entry, see Caching
+func (c *Cache) lookup(key cacheKey, r *Message, now time.Time, prefetch bool) (reply *Message, stale, ok bool) {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	elem, ok := sh.entries[key]
+	var entry *cacheEntry
+	if ok {
+		entry = elem.Value.(*cacheEntry)
+		if now.Before(entry.expires) {
+			sh.lru.MoveToFront(elem)
+			entry.hits++
+			stale = prefetch && c.shouldPrefetch(entry, now)
+		} else {
+			sh.remove(elem)
+			ok = false
+		}
+	}
+	sh.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false, false
+	}
+	c.hits.Add(1)
+
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	reply = NewReply(r)
+	reply.Header.Flag.SetRA(true)
+	reply.SetRCode(entry.rcode)
+	reply.Answers = agedRecords(entry.answers, age)
+	reply.Authorities = agedRecords(entry.authorities, age)
+	reply.Additionals = append(reply.Additionals, agedRecords(entry.additionals, age)...)
+	return reply, stale, true
+}
+
+// shouldPrefetch reports whether entry is popular and close enough to expiry
+// to be refreshed now, claiming one of the maxPrefetches refresh slots if so.
+// The shard must be locked
+func (c *Cache) shouldPrefetch(entry *cacheEntry, now time.Time) bool {
+	if entry.prefetched || entry.hits < prefetchMinHits {
+		return false
+	}
+	if entry.expires.Sub(now) > entry.expires.Sub(entry.stored)/prefetchFraction {
+		return false
+	}
+	if c.prefetching.Add(1) > maxPrefetches {
+		c.prefetching.Add(-1)
+		return false
+	}
+	entry.prefetched = true
+	return true
+}
+
+// prefetch looks q up again through next and caches the fresh reply. w
+// carries the addresses of the client that found the entry stale, so the
+// handler treats the query as that client's, but the reply goes nowhere
+func (c *Cache) prefetch(next Handler, w *prefetchWriter, key cacheKey, q *Question) {
+	defer c.prefetching.Add(-1)
+
+	query := NewQuery(randomID(), q.Name, q.Type, true)
+	query.Questions[0].Class = q.Class
+	next.ServeDNS(w, query)
+	if w.reply != nil {
+		c.prefetches.Add(1)
+		c.store(key, w.reply, time.Now())
+	}
+}
+
+// prefetchWriter keeps the reply to a prefetch instead of sending it. It only
+// holds the addresses of the client's exchange, which is over by the time the
+// prefetch runs
+type prefetchWriter struct {
+	local, remote net.Addr
+	network       string
+	reply         *Message
+}
+
+// newPrefetchWriter returns a prefetchWriter with the addresses of w
+func newPrefetchWriter(w ResponseWriter) *prefetchWriter {
+	return &prefetchWriter{local: w.LocalAddr(), remote: w.RemoteAddr(), network: w.Network()}
+}
+
+func (w *prefetchWriter) WriteMsg(m *Message) error {
+	w.reply = m
+	return nil
+}
+
+func (w *prefetchWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *prefetchWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *prefetchWriter) Network() string {
+	return w.network
+}
+
+// agedRecords returns copies of records with age seconds taken off their TTLs
+func agedRecords(records []*ResourceRecord, age uint32) []*ResourceRecord {
+	aged := make([]*ResourceRecord, len(records))
+	for i, rr := range records {
+		copied := *rr
+		copied.TTL -= min(age, copied.TTL)
+		aged[i] = &copied
+	}
+	return aged
+}
+
+// cappedRecords returns copies of records with their TTLs lowered to at most
+// ttl
+func cappedRecords(records []*ResourceRecord, ttl uint32) []*ResourceRecord {
+	capped := make([]*ResourceRecord, len(records))
+	for i, rr := range records {
+		copied := *rr
+		copied.TTL = min(copied.TTL, ttl)
+		capped[i] = &copied
+	}
+	return capped
+}
+
+// store caches reply under key for its TTL, or the cap set for its name by
+// CapTTL if lower, unless it should not be cached. Returns how long it is
+// cached for, or false if it is not
+func (c *Cache) store(key cacheKey, reply *Message, now time.Time) (time.Duration, bool) {
+	ttl, ok := cacheTTL(reply)
+	if !ok {
+		return 0, false
+	}
+
+	entry := &cacheEntry{
+		key:         key,
+		rcode:       reply.RCode(),
+		answers:     reply.Answers,
+		authorities: reply.Authorities,
+		stored:      now,
+	}
+	for _, rr := range reply.Additionals {
+		if rr.Type != OPT {
+			entry.additionals = append(entry.additionals, rr)
+		}
+	}
+	if limit, capped := c.ttlCap(key.name); capped && ttl > limit {
+		if limit < time.Second {
+			return 0, false
+		}
+		ttl = limit
+		seconds := uint32(limit / time.Second)
+		entry.answers = cappedRecords(entry.answers, seconds)
+		entry.authorities = cappedRecords(entry.authorities, seconds)
+		entry.additionals = cappedRecords(entry.additionals, seconds)
+	}
+	entry.expires = now.Add(ttl)
+
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if elem, ok := sh.entries[key]; ok {
+		sh.remove(elem)
+	}
+	for len(sh.entries) >= sh.maxEntries {
+		sh.remove(sh.lru.Back())
+		c.evictions.Add(1)
+	}
+	sh.entries[key] = sh.lru.PushFront(entry)
+	return ttl, true
+}
+
+// cacheTTL returns how long reply may be cached: the lowest TTL of its
+// records, or for NXDOMAIN and NODATA the negative TTL of the SOA record in
+// its authority section (RFC 2308 §5). Replies that are not recursive,
+// truncated, failed or without any TTL to go by are not cached
+func cacheTTL(reply *Message) (time.Duration, bool) {
+	if !reply.Header.Flag.GetRA() || reply.Header.Flag.GetTC() {
+		return 0, false
+	}
+	rcode := reply.RCode()
+	if rcode != RCodeNoError && rcode != RCodeNXDomain {
+		return 0, false
+	}
+
+	if rcode == RCodeNXDomain || len(reply.Answers) == 0 {
+		for _, rr := range reply.Authorities {
+			if rr.Type == SOA && len(rr.Data) >= 4 {
+				minimum := binary.BigEndian.Uint32(rr.Data[len(rr.Data)-4:])
+				ttl := time.Duration(min(rr.TTL, minimum)) * time.Second
+				return min(ttl, maxNegativeCacheTTL), ttl > 0
+			}
+		}
+		return 0, false
+	}
+
+	lowest := uint32(maxCacheTTL / time.Second)
+	for _, section := range [][]*ResourceRecord{reply.Answers, reply.Authorities, reply.Additionals} {
+		for _, rr := range section {
+			if rr.Type != OPT {
+				lowest = min(lowest, rr.TTL)
+			}
+		}
+	}
+	return time.Duration(lowest) * time.Second, lowest > 0
+}
+
+// shrink halves every shard, dropping expired entries first and then the
+// least recently used, to relieve memory pressure
+func (c *Cache) shrink(now time.Time) {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for elem := sh.lru.Back(); elem != nil; {
+			prev := elem.Prev()
+			if !now.Before(elem.Value.(*cacheEntry).expires) {
+				sh.remove(elem)
+				c.evictions.Add(1)
+			}
+			elem = prev
+		}
+		for target := len(sh.entries) / 2; len(sh.entries) > target; {
+			sh.remove(sh.lru.Back())
+			c.evictions.Add(1)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// remove drops elem from the shard. The shard must be locked
+func (sh *cacheShard) remove(elem *list.Element) {
+	delete(sh.entries, elem.Value.(*cacheEntry).key)
+	sh.lru.Remove(elem)
+}
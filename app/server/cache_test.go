@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// transportFunc is a transport answering with a function
+type transportFunc func(ctx context.Context, query *Message) (*Message, error)
+
+func (f transportFunc) exchange(ctx context.Context, query *Message) (*Message, error) {
+	return f(ctx, query)
+}
+
+func TestCacheOnlyWithoutRD(t *testing.T) {
+	type step struct {
+		rd      bool
+		answers int
+		// upstream is how many queries have reached the upstream after it
+		upstream int32
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"cold cache", []step{{false, 0, 0}, {false, 0, 0}}},
+		{"after a recursive query", []step{{true, 1, 1}, {false, 1, 1}}},
+		{"empty reply is not cached", []step{{false, 0, 0}, {true, 1, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewForwarder([]string{"192.0.2.53"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var upstream atomic.Int32
+			f.upstreams[0].transport = transportFunc(func(ctx context.Context, query *Message) (*Message, error) {
+				upstream.Add(1)
+				reply := NewReply(query)
+				reply.Answers = []*ResourceRecord{NewARecord(query.Questions[0].Name, net.IPv4(192, 0, 2, 1), 300)}
+				return reply, nil
+			})
+			h := Chain(f, Caching(NewCache(100), nil))
+
+			for i, s := range tt.steps {
+				query := NewQuery(randomID(), "www.example.com", A, false)
+				query.Header.Flag.SetRD(s.rd)
+				w := &testWriter{}
+				h.ServeDNS(w, query)
+
+				reply := w.replies[0]
+				if len(reply.Answers) != s.answers || reply.RCode() != RCodeNoError {
+					t.Errorf("step %d: %s with %d answers, want NOERROR with %d", i, reply.RCode(), len(reply.Answers), s.answers)
+				}
+				if reply.Header.Flag.GetRD() != s.rd {
+					t.Errorf("step %d: RD not copied from the query", i)
+				}
+				if n := upstream.Load(); n != s.upstream {
+					t.Errorf("step %d: %d upstream queries, want %d", i, n, s.upstream)
+				}
+			}
+		})
+	}
+}
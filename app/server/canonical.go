@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// CanonicalName returns the canonical form of a domain name as defined in
+// RFC 4034 §6.2: every uppercase US-ASCII letter is replaced by its lowercase
+// equivalent and any trailing root dot is removed, so that the name encodes
+// the same way as EncodeDomainName expects
+func CanonicalName(name string) string {
+	return lowerASCII(strings.TrimSuffix(name, "."))
+}
+
+// lowerASCII replaces every uppercase US-ASCII letter of s by its lowercase
+// equivalent, leaving other bytes alone
+func lowerASCII(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+// CanonicalWireName returns the uncompressed wire format of the canonical form
+// of a domain name, which is the representation used when computing DNSSEC
+// signatures
+func CanonicalWireName(name string) ([]byte, error) {
+	return EncodeDomainName(CanonicalName(name))
+}
+
+// CompareCanonical compares two domain names using the canonical DNS name
+// order of RFC 4034 §6.1. Names are compared label by label starting from the
+// rightmost (most significant) label, each label being compared as a left
+// justified lowercase octet string; a name with fewer labels sorts first.
+// Returns -1 if a sorts before b, 1 if a sorts after b and 0 if they are equal
+func CompareCanonical(a, b string) int {
+	aLabels := canonicalLabels(a)
+	bLabels := canonicalLabels(b)
+
+	i, j := len(aLabels)-1, len(bLabels)-1
+	for i >= 0 && j >= 0 {
+		if c := strings.Compare(aLabels[i], bLabels[j]); c != 0 {
+			return c
+		}
+		i--
+		j--
+	}
+
+	switch {
+	case i < 0 && j < 0:
+		return 0
+	case i < 0:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// SortCanonical sorts a slice of domain names in place using canonical DNS
+// name order
+func SortCanonical(names []string) {
+	sort.SliceStable(names, func(i, j int) bool {
+		return CompareCanonical(names[i], names[j]) < 0
+	})
+}
+
+// canonicalLabels splits a domain name into its lowercase labels, returning
+// no labels for the root domain
+func canonicalLabels(name string) []string {
+	name = CanonicalName(name)
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// CanonicalRecord returns the canonical form of rr as defined in RFC 4034 §6.2,
+// the representation signed by an RRSIG: the owner name and the names inside
+// the RDATA of the types in canonicalLayouts are lowercased and uncompressed,
+// and the TTL is replaced by originalTTL, the Original TTL field of the
+// covering RRSIG
+func CanonicalRecord(rr *ResourceRecord, originalTTL uint32) ([]byte, error) {
+	canonical := ResourceRecord{
+		Name:  CanonicalName(rr.Name),
+		Type:  rr.Type,
+		Class: rr.Class,
+		TTL:   originalTTL,
+		Data:  canonicalRData(rr),
+	}
+	return canonical.Marshal()
+}
+
+// SortCanonicalRRSet sorts the records of an RRset in place into the
+// canonical order of RFC 4034 §6.3, comparing their canonical RDATA as left
+// justified octet strings. An RRset holds no duplicate records, so records
+// equal in canonical form to the one before them are dropped. Returns the
+// sorted RRset
+func SortCanonicalRRSet(rrset []*ResourceRecord) []*ResourceRecord {
+	rdata := make(map[*ResourceRecord][]byte, len(rrset))
+	for _, rr := range rrset {
+		rdata[rr] = canonicalRData(rr)
+	}
+	slices.SortStableFunc(rrset, func(a, b *ResourceRecord) int {
+		return bytes.Compare(rdata[a], rdata[b])
+	})
+	return slices.CompactFunc(rrset, func(a, b *ResourceRecord) bool {
+		return bytes.Equal(rdata[a], rdata[b])
+	})
+}
+
+// canonicalLayouts lays out the RDATA of the types whose names are
+// lowercased in canonical form: the list of RFC 4034 §6.2, without NSEC as
+// corrected by RFC 6840 §5.1. HINFO is listed too but holds no names
+var canonicalLayouts = map[QuestionType][]rdataField{
+	NS:    {rdataName},
+	MD:    {rdataName},
+	MF:    {rdataName},
+	CNAME: {rdataName},
+	SOA:   {rdataName, rdataName, 20},
+	MB:    {rdataName},
+	MG:    {rdataName},
+	MR:    {rdataName},
+	PTR:   {rdataName},
+	MINFO: {rdataName, rdataName},
+	MX:    {2, rdataName},
+	RP:    {rdataName, rdataName},
+	AFSDB: {2, rdataName},
+	RT:    {2, rdataName},
+	SIG:   {18, rdataName, rdataRest},
+	PX:    {2, rdataName, rdataName},
+	NXT:   {rdataName, rdataRest},
+	SRV:   {6, rdataName},
+	NAPTR: {4, rdataString, rdataString, rdataString, rdataName},
+	KX:    {2, rdataName},
+	A6:    {1, rdataA6},
+	DNAME: {rdataName},
+	RRSIG: {18, rdataName, rdataRest},
+}
+
+// canonicalRData returns the RDATA of rr with the names inside it lowercased.
+// RDATA holds no compression pointers once parsed, see expandRData. Types
+// without names, and RDATA that does not match its layout, are returned as is
+func canonicalRData(rr *ResourceRecord) []byte {
+	layout, ok := canonicalLayouts[rr.Type]
+	if !ok {
+		return rr.Data
+	}
+	data, err := rewriteRData(rr.Data, 0, len(rr.Data), layout, true)
+	if err != nil {
+		return rr.Data
+	}
+	return data
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// rdata concatenates the fields of a piece of RDATA
+func rdata(fields ...[]byte) []byte {
+	return bytes.Join(fields, nil)
+}
+
+func TestCanonicalRData(t *testing.T) {
+	tests := []struct {
+		name string
+		rr   *ResourceRecord
+		want []byte
+	}{
+		{
+			name: "MX",
+			rr:   &ResourceRecord{Type: MX, Data: rdata([]byte{0, 10}, wireName("Mail.Example.COM"))},
+			want: rdata([]byte{0, 10}, wireName("mail.example.com")),
+		},
+		{
+			name: "SRV",
+			rr:   &ResourceRecord{Type: SRV, Data: rdata([]byte{0, 1, 0, 2, 0x13, 0xc4}, wireName("SIP.Example.com"))},
+			want: rdata([]byte{0, 1, 0, 2, 0x13, 0xc4}, wireName("sip.example.com")),
+		},
+		{
+			name: "DNAME",
+			rr:   &ResourceRecord{Type: DNAME, Data: wireName("New.EXAMPLE.net")},
+			want: wireName("new.example.net"),
+		},
+		{
+			name: "MINFO",
+			rr:   &ResourceRecord{Type: MINFO, Data: rdata(wireName("Admin.Example.com"), wireName("Errors.Example.com"))},
+			want: rdata(wireName("admin.example.com"), wireName("errors.example.com")),
+		},
+		{
+			name: "NAPTR keeps its strings",
+			rr:   &ResourceRecord{Type: NAPTR, Data: rdata([]byte{0, 100, 0, 10}, []byte("\x01U"), []byte("\x07E2U+sip"), []byte{0}, wireName("_SIP._udp.Example.com"))},
+			want: rdata([]byte{0, 100, 0, 10}, []byte("\x01U"), []byte("\x07E2U+sip"), []byte{0}, wireName("_sip._udp.example.com")),
+		},
+		{
+			name: "RRSIG keeps its signature",
+			rr:   &ResourceRecord{Type: RRSIG, Data: rdata(make([]byte, 18), wireName("Example.com"), []byte("SigNature"))},
+			want: rdata(make([]byte, 18), wireName("example.com"), []byte("SigNature")),
+		},
+		{
+			name: "NSEC is left alone",
+			rr:   &ResourceRecord{Type: NSEC, Data: rdata(wireName("Next.Example.com"), []byte{0, 1, 0x40})},
+			want: rdata(wireName("Next.Example.com"), []byte{0, 1, 0x40}),
+		},
+		{
+			name: "malformed RDATA is left alone",
+			rr:   &ResourceRecord{Type: MX, Data: []byte{0, 10, 3, 'M', 'X'}},
+			want: []byte{0, 10, 3, 'M', 'X'},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canonicalRData(tt.rr); !bytes.Equal(got, tt.want) {
+				t.Errorf("canonicalRData = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortCanonicalRRSetDropsCaseDuplicates(t *testing.T) {
+	rrset := []*ResourceRecord{
+		{Name: "example.com", Type: MX, Class: 1, Data: rdata([]byte{0, 20}, wireName("b.example.com"))},
+		{Name: "example.com", Type: MX, Class: 1, Data: rdata([]byte{0, 10}, wireName("A.Example.com"))},
+		{Name: "example.com", Type: MX, Class: 1, Data: rdata([]byte{0, 10}, wireName("a.example.com"))},
+	}
+	sorted := SortCanonicalRRSet(rrset)
+	if len(sorted) != 2 {
+		t.Fatalf("got %d records, want 2", len(sorted))
+	}
+	if binary.BigEndian.Uint16(sorted[0].Data) != 10 || binary.BigEndian.Uint16(sorted[1].Data) != 20 {
+		t.Errorf("records not in canonical order: %v", sorted)
+	}
+}
+
+func TestParseExpandsCompressedMINFO(t *testing.T) {
+	// A reply to example.com MINFO whose RDATA names point at the question
+	msg := rdata(
+		[]byte{0x12, 0x34, 0x84, 0x00, 0, 1, 0, 1, 0, 0, 0, 0},
+		wireName("example.com"), []byte{0, byte(MINFO), 0, 1},
+		[]byte{0xc0, 12, 0, byte(MINFO), 0, 1, 0, 0, 0x0e, 0x10, 0, 18},
+		[]byte("\x05rmail\xc0\x0c\x07emailbx\xc0\x0c"),
+	)
+	m, err := ParseMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rdata(wireName("rmail.example.com"), wireName("emailbx.example.com"))
+	if got := m.Answers[0].Data; !bytes.Equal(got, want) {
+		t.Errorf("MINFO rdata = %q, want %q", got, want)
+	}
+	if err := checkRoundTrip(m); err != nil {
+		t.Error(err)
+	}
+}
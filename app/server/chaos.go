@@ -0,0 +1,64 @@
+//go:build chaos
+
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Fault injection for exercising retry and timeout logic. Only compiled in
+// with `-tags chaos` and configured through environment variables:
+//
+//	DNS_CHAOS_DROP     fraction (0 to 1) of packets silently dropped
+//	DNS_CHAOS_LATENCY  extra delay added before each packet, e.g. 200ms
+//	DNS_CHAOS_CORRUPT  fraction (0 to 1) of packets with one byte flipped
+var chaos = struct {
+	drop    float64
+	latency time.Duration
+	corrupt float64
+}{
+	drop:    chaosFloat("DNS_CHAOS_DROP"),
+	latency: chaosDuration("DNS_CHAOS_LATENCY"),
+	corrupt: chaosFloat("DNS_CHAOS_CORRUPT"),
+}
+
+// injectFault applies the configured faults to a packet at the named stage.
+// Returns the packet to use and whether it should be delivered at all
+func injectFault(stage string, packet []byte) ([]byte, bool) {
+	if chaos.latency > 0 {
+		time.Sleep(chaos.latency)
+	}
+	if chaos.drop > 0 && rand.Float64() < chaos.drop {
+		fmt.Printf("Chaos: dropped %s packet\n", stage)
+		return nil, false
+	}
+	if chaos.corrupt > 0 && len(packet) > 0 && rand.Float64() < chaos.corrupt {
+		corrupted := make([]byte, len(packet))
+		copy(corrupted, packet)
+		i := rand.IntN(len(corrupted))
+		corrupted[i] ^= byte(1 + rand.IntN(255))
+		fmt.Printf("Chaos: corrupted byte %d of %s packet\n", i, stage)
+		return corrupted, true
+	}
+	return packet, true
+}
+
+func chaosFloat(name string) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func chaosDuration(name string) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,8 @@
+//go:build !chaos
+
+package server
+
+// injectFault is a no-op outside chaos builds
+func injectFault(stage string, packet []byte) ([]byte, bool) {
+	return packet, true
+}
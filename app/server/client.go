@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// NewQuery builds a recursive query for a single question, advertising
+// ednsUDPSize in an OPT record when edns is set
+func NewQuery(id uint16, name string, qt QuestionType, edns bool) *Message {
+	header := &Header{
+		ID:   id,
+		Flag: NewFlag([]byte{0x00, 0x00}),
+	}
+	header.Flag.SetRD(true)
+
+	m := &Message{
+		Header:    header,
+		Questions: []*Question{{Name: name, Type: qt, Class: 1}},
+	}
+	if edns {
+		m.Additionals = []*ResourceRecord{NewOPT(ednsUDPSize)}
+	}
+	return m
+}
+
+// Exchange sends query to the DNS server at addr over network ("udp" or
+// "tcp") and returns the parsed reply
+func Exchange(ctx context.Context, network, addr string, query *Message) (*Message, error) {
+	raw, err := exchange(ctx, network, addr, query)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMessage(raw)
+}
+
+// exchange sends query to addr over a connection of its own and returns the
+// raw reply
+func exchange(ctx context.Context, network, addr string, query *Message) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if network == "udp" {
+		conn, err = dialUDP(ctx, addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeConn(ctx, conn, network != "udp", query)
+}
+
+// exchangeConn sends query on conn and returns the raw reply. stream selects
+// the length-prefixed framing of TCP and TLS; on a stream the reply must
+// match the query's ID and question, while over UDP datagrams are ignored
+// unless they come from the upstream's address and match, as are those
+// dropped by fault injection. If ctx ends first conn is closed;
+// otherwise it is left usable for another query
+func exchangeConn(ctx context.Context, conn net.Conn, stream bool, query *Message) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	reply, err := exchangeFramed(conn, stream, query)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return reply, nil
+}
+
+// exchangeFramed does the I/O of exchangeConn
+func exchangeFramed(conn net.Conn, stream bool, query *Message) ([]byte, error) {
+	packet, err := query.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if stream {
+		reply, err := exchangeTCP(conn, packet)
+		if err != nil {
+			return nil, err
+		}
+		if !matchesQuery(reply, query) {
+			return nil, errors.New("dns: reply does not match the query")
+		}
+		return reply, nil
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	udpConn, _ := conn.(*net.UDPConn)
+	buf := make([]byte, maxUDPReadSize)
+	for {
+		var n int
+		var err error
+		if udpConn != nil {
+			var source *net.UDPAddr
+			if n, source, err = udpConn.ReadFromUDP(buf); err == nil && !fromPeer(conn, source) {
+				continue
+			}
+		} else {
+			n, err = conn.Read(buf)
+		}
+		if err != nil {
+			return nil, err
+		}
+		reply, deliver := injectFault("upstream", buf[:n])
+		if deliver && matchesQuery(reply, query) {
+			return reply, nil
+		}
+	}
+}
+
+// exchangeTCP writes a length-prefixed query to conn and reads back the
+// length-prefixed reply
+func exchangeTCP(conn net.Conn, packet []byte) ([]byte, error) {
+	if len(packet) > maxTCPSize {
+		return nil, fmt.Errorf("dns: message of %d bytes too large for TCP", len(packet))
+	}
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(packet)))
+	if _, err := conn.Write(append(buf, packet...)); err != nil {
+		return nil, err
+	}
+
+	return readFrame(conn)
+}
+
+// readFrame reads a length-prefixed message from conn
+func readFrame(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
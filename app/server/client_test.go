@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestExchangeConnStreamMatchesQuestion(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(query *Message) *Message
+		wantErr bool
+	}{
+		{"matching reply", NewReply, false},
+		{"wrong ID", func(query *Message) *Message {
+			reply := NewReply(query)
+			reply.Header.ID++
+			return reply
+		}, true},
+		{"wrong question", func(query *Message) *Message {
+			return NewReply(NewQuery(query.Header.ID, "other.example.com", A, false))
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, upstream := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer upstream.Close()
+				raw, err := readFrame(upstream)
+				if err != nil {
+					return
+				}
+				query, err := ParseMessage(raw)
+				if err != nil {
+					return
+				}
+				packet, err := tt.reply(query).Marshal()
+				if err != nil {
+					return
+				}
+				upstream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...))
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := exchangeConn(ctx, client, true, NewQuery(randomID(), "www.example.com", A, false))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
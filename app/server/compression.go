@@ -0,0 +1,53 @@
+package server
+
+import "strings"
+
+// compressionMap records the message offset at which each domain name suffix
+// was first written, so later occurrences can be encoded as pointers
+// (RFC 1035 §4.1.4). Keys are case-preserving so compression never changes
+// the case of a name on the wire
+type compressionMap map[string]int
+
+// maxPointerOffset is the largest offset a 14 bit compression pointer can hold
+const maxPointerOffset = 0x3FFF
+
+// appendDomainName appends name in DNS wire format to buf, which must hold the
+// message written so far. If comp is not nil, the longest suffix of name that
+// was already written is replaced by a pointer and any new suffixes are
+// recorded for later names. Fails if name is too long for the wire, see
+// checkDomainName
+func appendDomainName(buf []byte, name string, comp compressionMap) ([]byte, error) {
+	if comp == nil {
+		encoded, err := EncodeDomainName(name)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, encoded...), nil
+	}
+	if err := checkDomainName(name); err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > 0 {
+			labels = append(labels, label)
+		}
+	}
+
+	for i, label := range labels {
+		suffix := strings.Join(labels[i:], ".")
+		if pointer, ok := comp[suffix]; ok {
+			return append(buf, 0xC0|byte(pointer>>8), byte(pointer)), nil
+		}
+		if len(buf) <= maxPointerOffset {
+			comp[suffix] = len(buf)
+		}
+
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+
+	// Terminate with a zero byte
+	return append(buf, 0), nil
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMaxConnsPerHost is how many connections are kept open per upstream
+	defaultMaxConnsPerHost = 4
+
+	// defaultPoolIdleTimeout is how long a connection may sit idle in the pool
+	// before it is closed. Upstreams close idle connections themselves after
+	// some seconds (RFC 7766 §6.2.3), so there is no point keeping them longer
+	defaultPoolIdleTimeout = 30 * time.Second
+
+	// pipelineDepth is how many queries may be outstanding on a connection
+	// before another one is opened to the same upstream, as long as the
+	// per-host limit allows
+	pipelineDepth = 16
+)
+
+// errConnIdle closes a pooled connection that sat idle too long
+var errConnIdle = errors.New("dns: upstream connection idle")
+
+// ConnPool keeps outbound connections to upstreams open between queries. It
+// is shared by every upstream transport of a Forwarder. TCP and TLS
+// connections are long-lived and pipelined: queries are written as they come
+// without waiting for earlier replies, which are matched back by ID in
+// whatever order the upstream sends them (RFC 7766 §6.2.1.1). DoH uses its
+// limits for its HTTP connections, and UDP sockets are dialed through it only
+// to be counted, as each UDP query gets a fresh socket and so a fresh random
+// source port
+type ConnPool struct {
+	maxConnsPerHost int
+	idleTimeout     time.Duration
+
+	// mu guards conns and the state of every pipeConn
+	mu    sync.Mutex
+	conns map[string][]*pipeConn
+
+	dials     atomic.Uint64
+	reuses    atomic.Uint64
+	pipelined atomic.Uint64
+	expired   atomic.Uint64
+	failed    atomic.Uint64
+
+	idCollisions atomic.Uint64
+	idStarved    atomic.Uint64
+}
+
+// PoolStats are the counters of a ConnPool
+type PoolStats struct {
+	Dials     uint64 // Connections opened
+	Reuses    uint64 // Queries sent on a connection opened for an earlier one
+	Pipelined uint64 // Queries sent while others were outstanding on the connection
+	Expired   uint64 // Connections closed after the idle timeout
+	Failed    uint64 // Connections dropped after an error
+	Open      int    // Connections currently open in the pool
+
+	IDCollisions uint64 // Queries whose ID was in flight on the connection and got another
+	IDStarved    uint64 // Queries finding every ID in flight on the connection
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf("%d dials, %d reuses, %d pipelined, %d expired, %d failed, %d open, %d ID collisions, %d ID starved",
+		s.Dials, s.Reuses, s.Pipelined, s.Expired, s.Failed, s.Open, s.IDCollisions, s.IDStarved)
+}
+
+// NewConnPool builds a pool keeping up to maxConnsPerHost connections open
+// per upstream, each closed once it has been idle for idleTimeout
+func NewConnPool(maxConnsPerHost int, idleTimeout time.Duration) *ConnPool {
+	return &ConnPool{
+		maxConnsPerHost: maxConnsPerHost,
+		idleTimeout:     idleTimeout,
+		conns:           make(map[string][]*pipeConn),
+	}
+}
+
+// Stats returns a snapshot of the pool's counters
+func (p *ConnPool) Stats() PoolStats {
+	p.mu.Lock()
+	open := 0
+	for _, conns := range p.conns {
+		open += len(conns)
+	}
+	p.mu.Unlock()
+
+	return PoolStats{
+		Dials:     p.dials.Load(),
+		Reuses:    p.reuses.Load(),
+		Pipelined: p.pipelined.Load(),
+		Expired:   p.expired.Load(),
+		Failed:    p.failed.Load(),
+		Open:      open,
+
+		IDCollisions: p.idCollisions.Load(),
+		IDStarved:    p.idStarved.Load(),
+	}
+}
+
+// dialFunc opens a new connection to an upstream
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+// dial opens a connection that is not pooled, counting it
+func (p *ConnPool) dial(ctx context.Context, dial dialFunc) (net.Conn, error) {
+	p.dials.Add(1)
+	return dial(ctx)
+}
+
+// exchange sends query over a pooled stream connection for key and returns
+// the raw reply. The upstream may have closed a connection the pool still
+// holds, so one failure on a reused connection is retried. A connection that
+// failed has left the pool, so the retry gets a fresh one within the per-host
+// limit, or another open connection if the pool is full
+func (p *ConnPool) exchange(ctx context.Context, key string, dial dialFunc, query *Message) ([]byte, error) {
+	pc, reused := p.get(key, dial)
+	reply, err := pc.exchange(ctx, query)
+	if err != nil && reused && ctx.Err() == nil {
+		pc, _ = p.get(key, dial)
+		reply, err = pc.exchange(ctx, query)
+	}
+	return reply, err
+}
+
+// get returns the connection for key with the fewest outstanding queries,
+// reserving a place on it. A new one is opened instead if every connection
+// has a full pipeline and the per-host limit allows, or if there is none.
+// reused reports whether the connection was already in the pool
+func (p *ConnPool) get(key string, dial dialFunc) (pc *pipeConn, reused bool) {
+	p.mu.Lock()
+	for _, c := range p.conns[key] {
+		if pc == nil || c.load < pc.load {
+			pc = c
+		}
+	}
+	if pc != nil && (pc.load < pipelineDepth || len(p.conns[key]) >= p.maxConnsPerHost) {
+		pc.load++
+		p.mu.Unlock()
+		p.reuses.Add(1)
+		return pc, true
+	}
+	p.mu.Unlock()
+	return p.open(key, dial), false
+}
+
+// open adds a new connection for key to the pool, reserving a place on it.
+// It is dialed in the background so queries arriving meanwhile can wait on it
+// instead of each dialing their own
+func (p *ConnPool) open(key string, dial dialFunc) *pipeConn {
+	pc := &pipeConn{
+		pool:    p,
+		key:     key,
+		ready:   make(chan struct{}),
+		pending: make(map[uint16]pendingQuery),
+		load:    1,
+	}
+	p.mu.Lock()
+	p.conns[key] = append(p.conns[key], pc)
+	p.mu.Unlock()
+
+	go pc.connect(dial)
+	return pc
+}
+
+// pipeConn is a pooled stream connection carrying any number of outstanding
+// queries, keyed by the ID they were sent with, see idspace.go
+type pipeConn struct {
+	pool  *ConnPool
+	key   string
+	conn  net.Conn
+	ready chan struct{} // closed once dialed, or once dialing failed
+
+	// writeMu keeps the frames of concurrent queries from interleaving
+	writeMu sync.Mutex
+
+	// The fields below are guarded by pool.mu
+	ids     idSpace
+	pending map[uint16]pendingQuery
+	// load counts the queries using or waiting on the connection
+	load int
+	// readDeadline is the latest deadline of the outstanding queries; the
+	// connection is dropped if the upstream stays silent past it
+	readDeadline time.Time
+	// err is set once the connection has failed, after which it takes no
+	// more queries
+	err  error
+	idle *time.Timer
+}
+
+// pendingQuery is a query waiting for its reply on a pipeConn
+type pendingQuery struct {
+	// wire is the query as sent, with the ID it was given on the connection
+	wire  *Message
+	reply chan []byte
+}
+
+// connect dials the connection and starts reading replies from it
+func (pc *pipeConn) connect(dial dialFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultForwardTimeout)
+	defer cancel()
+	conn, err := pc.pool.dial(ctx, dial)
+	defer close(pc.ready)
+
+	if err != nil {
+		pc.fail(err)
+		return
+	}
+	pc.pool.mu.Lock()
+	pc.conn = conn
+	pc.idle = time.AfterFunc(pc.pool.idleTimeout, pc.expire)
+	pc.pool.mu.Unlock()
+	go pc.read()
+}
+
+// exchange sends query on the connection and waits for its reply, releasing
+// the place reserved by get or open. If the query's ID is already in flight
+// on the connection another one is sent on the wire, and the reply is given
+// the query's ID back
+func (pc *pipeConn) exchange(ctx context.Context, query *Message) ([]byte, error) {
+	var (
+		id        uint16
+		allocated bool
+	)
+	defer func() {
+		pc.release(id, allocated)
+	}()
+
+	select {
+	case <-pc.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p := pc.pool
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultForwardTimeout)
+	}
+
+	p.mu.Lock()
+	if pc.err != nil {
+		p.mu.Unlock()
+		return nil, pc.err
+	}
+	id, collided, allocated := pc.ids.alloc(query.Header.ID)
+	if collided {
+		p.idCollisions.Add(1)
+	}
+	if !allocated {
+		p.idStarved.Add(1)
+		p.mu.Unlock()
+		return nil, errIDsExhausted
+	}
+
+	header := *query.Header
+	header.ID = id
+	wire := *query
+	wire.Header = &header
+	ch := make(chan []byte, 1)
+	pc.pending[id] = pendingQuery{wire: &wire, reply: ch}
+	if len(pc.pending) > 1 {
+		p.pipelined.Add(1)
+	}
+	if deadline.After(pc.readDeadline) {
+		pc.readDeadline = deadline
+		pc.conn.SetReadDeadline(deadline)
+	}
+	p.mu.Unlock()
+
+	packet, err := wire.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if len(packet) > maxTCPSize {
+		return nil, fmt.Errorf("dns: message of %d bytes too large for TCP", len(packet))
+	}
+
+	pc.writeMu.Lock()
+	pc.conn.SetWriteDeadline(deadline)
+	_, err = pc.conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...))
+	pc.writeMu.Unlock()
+	if err != nil {
+		// A partly written frame leaves the stream unusable
+		pc.fail(err)
+		return nil, err
+	}
+
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return nil, pc.err
+		}
+		binary.BigEndian.PutUint16(reply, query.Header.ID)
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release frees a place on the connection once an exchange is over, along
+// with its ID if it was allocated one, and starts the idle timer if it was
+// the last
+func (pc *pipeConn) release(id uint16, allocated bool) {
+	p := pc.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if allocated {
+		delete(pc.pending, id)
+		pc.ids.free(id)
+	}
+	// A connection still being dialed starts its idle timer once connected
+	if pc.load--; pc.err == nil && pc.load == 0 && pc.conn != nil {
+		pc.readDeadline = time.Time{}
+		pc.conn.SetReadDeadline(time.Time{})
+		pc.idle.Reset(p.idleTimeout)
+	}
+}
+
+// read delivers the replies arriving on the connection to the queries
+// waiting for them until the connection fails. Replies nobody waits for, such
+// as those to queries that timed out, are dropped, as are those not echoing
+// the question of the query holding their ID
+func (pc *pipeConn) read() {
+	for {
+		reply, err := readFrame(pc.conn)
+		if err != nil {
+			pc.fail(err)
+			return
+		}
+		if len(reply) < 2 {
+			continue
+		}
+
+		id := binary.BigEndian.Uint16(reply)
+		pc.pool.mu.Lock()
+		if q, ok := pc.pending[id]; ok && matchesQuery(reply, q.wire) {
+			delete(pc.pending, id)
+			q.reply <- reply
+		}
+		pc.pool.mu.Unlock()
+	}
+}
+
+// expire closes the connection once its idle timeout passes, unless a query
+// started using it in the meantime
+func (pc *pipeConn) expire() {
+	pc.pool.mu.Lock()
+	idle := pc.err == nil && pc.load == 0
+	pc.pool.mu.Unlock()
+
+	if idle {
+		pc.pool.expired.Add(1)
+		pc.fail(errConnIdle)
+	}
+}
+
+// fail closes the connection, removes it from the pool and fails every query
+// outstanding on it with err. Only the first call has any effect
+func (pc *pipeConn) fail(err error) {
+	p := pc.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc.err != nil {
+		return
+	}
+
+	pc.err = err
+	if err != errConnIdle {
+		p.failed.Add(1)
+	}
+	if pc.conn != nil {
+		pc.idle.Stop()
+		pc.conn.Close()
+	}
+	for id, q := range pc.pending {
+		close(q.reply)
+		delete(pc.pending, id)
+	}
+
+	conns := p.conns[pc.key]
+	for i, c := range conns {
+		if c == pc {
+			p.conns[pc.key] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(p.conns[pc.key]) == 0 {
+		delete(p.conns, pc.key)
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// defaultTopN is how many entries of each kind /top returns without ?n=
+const defaultTopN = 10
+
+// ControlHandler serves the server's live statistics over HTTP as JSON, for
+// dnsctl and other tooling. It should only be reachable by operators:
+//
+//	GET /top?n=10  the top talkers report, see QueryStats.Top
+//	GET /types     the queries received per type, see QueryStats.Types
+func (s *DNSServer) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /top", func(w http.ResponseWriter, r *http.Request) {
+		n := defaultTopN
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 1 {
+				http.Error(w, fmt.Sprintf("invalid n %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		writeControlJSON(w, r, s.stats.Top(n))
+	})
+	mux.HandleFunc("GET /types", func(w http.ResponseWriter, r *http.Request) {
+		writeControlJSON(w, r, s.stats.Types())
+	})
+	return mux
+}
+
+// writeControlJSON writes v as the JSON reply to r
+func writeControlJSON(w http.ResponseWriter, r *http.Request, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Failed to write control reply to %s: %v\n", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestControlTypes(t *testing.T) {
+	s := NewDnsServer(nil)
+	for _, qt := range []QuestionType{A, AAAA, A, 65, A, 65, 65280} {
+		s.Stats().Record(qt)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ControlHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/types", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /types answered %d", rec.Code)
+	}
+	var report TypeReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  []TopEntry
+		want []TopEntry
+	}{
+		{"types", report.Types, []TopEntry{{"A", 3}, {"TYPE65", 2}, {"AAAA", 1}, {"TYPE65280", 1}}},
+		{"unknown", report.Unknown, []TopEntry{{"TYPE65", 2}, {"TYPE65280", 1}}},
+	}
+	for _, tt := range tests {
+		if !slices.Equal(tt.got, tt.want) {
+			t.Errorf("%s %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build debug
+
+package server
+
+// debugBuild enables extra self-checks on outgoing messages. Build with
+// `-tags debug` to turn it on
+const debugBuild = true
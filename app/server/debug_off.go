@@ -0,0 +1,5 @@
+//go:build !debug
+
+package server
+
+const debugBuild = false
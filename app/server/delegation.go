@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// delegation is a child zone served by internal name servers, which queries
+// under it are sent to directly instead of the upstreams
+type delegation struct {
+	zone string
+	// glue are the servers whose addresses are known up front
+	glue []*upstream
+	// names are name servers without glue, looked up through the upstreams
+	// when needed
+	names []string
+
+	mu       sync.Mutex
+	resolved map[string]resolvedServer
+}
+
+// maxNameServerTTL bounds how long the looked up addresses of a name server
+// without glue are kept, whatever the TTL of their records
+const maxNameServerTTL = time.Minute
+
+// resolvedServer caches the addresses of a name server without glue
+type resolvedServer struct {
+	upstreams []*upstream
+	expires   time.Time
+}
+
+// WithDelegation sends queries for names at or below zone to servers rather
+// than the upstreams. Each server is an address (port 53 if omitted), a
+// name server name looked up through the upstreams, or name@address to give
+// its glue address directly, e.g. ns1.corp.example@10.0.0.53. Names are
+// always queried on port 53, so a name with a port is rejected by
+// NewForwarder: give its address instead. The deepest matching delegation
+// wins
+func WithDelegation(zone string, servers ...string) ForwarderOption {
+	return func(f *Forwarder) {
+		d := &delegation{
+			zone:     CanonicalName(zone),
+			resolved: make(map[string]resolvedServer),
+		}
+		for _, server := range servers {
+			name, addr, hasGlue := strings.Cut(server, "@")
+			if !hasGlue {
+				host, _, err := net.SplitHostPort(server)
+				if err != nil {
+					host = server
+				}
+				if net.ParseIP(strings.Trim(host, "[]")) == nil {
+					if err == nil {
+						if f.err == nil {
+							f.err = fmt.Errorf("dns: delegation %s: name server %s has a port, use name@address:port", zone, server)
+						}
+						continue
+					}
+					d.names = append(d.names, CanonicalName(name))
+					continue
+				}
+				addr = server
+			}
+			addr = withDefaultPort(addr, "53")
+			d.glue = append(d.glue, &upstream{addr: addr, transport: plainTransport{addr: addr, pool: f.pool}})
+		}
+		f.delegations = append(f.delegations, d)
+	}
+}
+
+// delegationFor returns the deepest delegation name falls under, or nil
+func (f *Forwarder) delegationFor(name string) *delegation {
+	name = CanonicalName(name)
+	var best *delegation
+	for _, d := range f.delegations {
+		if name != d.zone && !strings.HasSuffix(name, "."+d.zone) {
+			continue
+		}
+		if best == nil || len(d.zone) > len(best.zone) {
+			best = d
+		}
+	}
+	return best
+}
+
+// resolveServers returns the delegation's servers, looking up the addresses
+// of name servers without glue through f's upstreams. Lookups are cached for
+// the TTL of their answers
+func (d *delegation) resolveServers(ctx context.Context, f *Forwarder) ([]*upstream, error) {
+	servers := append([]*upstream(nil), d.glue...)
+	var errs []error
+	for _, name := range d.names {
+		upstreams, err := d.lookup(ctx, f, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		servers = append(servers, upstreams...)
+	}
+	if len(servers) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return servers, nil
+}
+
+// lookup returns the upstreams for the addresses of name server name
+func (d *delegation) lookup(ctx context.Context, f *Forwarder, name string) ([]*upstream, error) {
+	now := time.Now()
+	d.mu.Lock()
+	cached, ok := d.resolved[name]
+	d.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.upstreams, nil
+	}
+
+	// Looked up through the upstreams directly: a name server inside its own
+	// zone needs glue, so going through the delegation could only loop
+	var upstreams []*upstream
+	// Either lookup is enough: internal servers often fail AAAA queries
+	var errs []error
+	ttl := uint32(maxNameServerTTL / time.Second)
+	for _, qt := range []QuestionType{A, AAAA} {
+		q := &Question{Name: name, Type: qt, Class: 1}
+		reply, err := f.resolveFrom(ctx, orderUpstreams(f.upstreams), q, false, false)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range reply.Answers {
+			if (rr.Type == A && len(rr.Data) == net.IPv4len) || (rr.Type == AAAA && len(rr.Data) == net.IPv6len) {
+				addr := net.JoinHostPort(net.IP(rr.Data).String(), "53")
+				upstreams = append(upstreams, d.server(f, cached.upstreams, addr))
+				ttl = min(ttl, rr.TTL)
+			}
+		}
+	}
+	if len(errs) == 2 {
+		return nil, fmt.Errorf("looking up name server %s: %w", name, errors.Join(errs...))
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("name server %s has no address", name)
+	}
+
+	d.mu.Lock()
+	d.resolved[name] = resolvedServer{
+		upstreams: upstreams,
+		expires:   now.Add(time.Duration(ttl) * time.Second),
+	}
+	d.mu.Unlock()
+	return upstreams, nil
+}
+
+// server returns the upstream for addr from previous, so its health and RTT
+// carry over when a lookup is refreshed, or a new one
+func (d *delegation) server(f *Forwarder, previous []*upstream, addr string) *upstream {
+	for _, u := range previous {
+		if u.addr == addr {
+			return u
+		}
+	}
+	return &upstream{addr: addr, transport: plainTransport{addr: addr, pool: f.pool}}
+}
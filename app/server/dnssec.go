@@ -0,0 +1,62 @@
+package server
+
+// dnssecTypes are the records a server only includes for clients that set
+// DO, unless they were asked for by type (RFC 4035 §3.2.1)
+var dnssecTypes = map[QuestionType]bool{
+	RRSIG: true,
+	NSEC:  true,
+	NSEC3: true,
+}
+
+// StripDNSSEC removes the RRSIG, NSEC and NSEC3 records from the replies to
+// queries without the DO bit. Forwarded and recursive queries always ask
+// upstreams for them, so handlers below it, the cache included, keep them for
+// the clients that do set DO
+func StripDNSSEC() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			if dnssecOK(r) {
+				next.ServeDNS(w, r)
+				return
+			}
+			next.ServeDNS(dnssecWriter{ResponseWriter: w, query: r}, r)
+		})
+	}
+}
+
+// dnssecWriter writes replies without the DNSSEC records the query did not ask
+// for. The reply is copied rather than changed, as handlers below may keep it
+type dnssecWriter struct {
+	ResponseWriter
+	query *Message
+}
+
+func (w dnssecWriter) WriteMsg(m *Message) error {
+	stripped := *m
+	stripped.Answers = w.withoutDNSSEC(m.Answers)
+	stripped.Authorities = w.withoutDNSSEC(m.Authorities)
+	stripped.Additionals = w.withoutDNSSEC(m.Additionals)
+	return w.ResponseWriter.WriteMsg(&stripped)
+}
+
+// withoutDNSSEC returns the records that are not DNSSEC records, or whose type
+// a question of the query asked for
+func (w dnssecWriter) withoutDNSSEC(records []*ResourceRecord) []*ResourceRecord {
+	var kept []*ResourceRecord
+	for _, rr := range records {
+		if !dnssecTypes[rr.Type] || w.askedFor(rr.Type) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// askedFor reports whether a question of the query is for qtype
+func (w dnssecWriter) askedFor(qtype QuestionType) bool {
+	for _, q := range w.query.Questions {
+		if q.Type == qtype {
+			return true
+		}
+	}
+	return false
+}
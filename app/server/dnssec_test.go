@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testWriter is a ResponseWriter keeping the replies written to it
+type testWriter struct {
+	replies []*Message
+}
+
+func (w *testWriter) WriteMsg(m *Message) error {
+	w.replies = append(w.replies, m)
+	return nil
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w *testWriter) Network() string {
+	return "udp"
+}
+
+// testQuery returns a recursive query for name and qtype with EDNS, setting
+// DO if do is true
+func testQuery(name string, qtype QuestionType, do bool) *Message {
+	query := NewQuery(randomID(), name, qtype, true)
+	setOptDO(query.OPT(), do)
+	return query
+}
+
+// signedReply answers r like a validating upstream: an A record and its RRSIG,
+// with an NSEC record in the authority section
+func signedReply(r *Message) *Message {
+	reply := NewReply(r)
+	reply.Header.Flag.SetRA(true)
+	name := r.Questions[0].Name
+	reply.Answers = []*ResourceRecord{
+		NewARecord(name, net.IPv4(192, 0, 2, 1), 300),
+		{Name: name, Type: RRSIG, Class: 1, TTL: 300, Data: rdata(make([]byte, 18), wireName("example.com"), []byte("sig"))},
+	}
+	reply.Authorities = []*ResourceRecord{
+		{Name: name, Type: NSEC, Class: 1, TTL: 300, Data: rdata(wireName("z.example.com"), []byte{0, 1, 0x40})},
+	}
+	return reply
+}
+
+// recordTypes lists the types of records, in order
+func recordTypes(records []*ResourceRecord) []QuestionType {
+	var types []QuestionType
+	for _, rr := range records {
+		types = append(types, rr.Type)
+	}
+	return types
+}
+
+func TestStripDNSSEC(t *testing.T) {
+	tests := []struct {
+		name        string
+		qtype       QuestionType
+		do          bool
+		answers     []QuestionType
+		authorities []QuestionType
+	}{
+		{"DO set", A, true, []QuestionType{A, RRSIG}, []QuestionType{NSEC}},
+		{"DO unset", A, false, []QuestionType{A}, nil},
+		{"DO unset asking for RRSIG", RRSIG, false, []QuestionType{A, RRSIG}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Chain(HandlerFunc(func(w ResponseWriter, r *Message) {
+				w.WriteMsg(signedReply(r))
+			}), StripDNSSEC())
+			w := &testWriter{}
+			h.ServeDNS(w, testQuery("www.example.com", tt.qtype, tt.do))
+
+			reply := w.replies[0]
+			if got := recordTypes(reply.Answers); !slices.Equal(got, tt.answers) {
+				t.Errorf("answers %v, want %v", got, tt.answers)
+			}
+			if got := recordTypes(reply.Authorities); !slices.Equal(got, tt.authorities) {
+				t.Errorf("authorities %v, want %v", got, tt.authorities)
+			}
+		})
+	}
+}
+
+func TestCacheKeepsDNSSECRecords(t *testing.T) {
+	calls := 0
+	h := Chain(HandlerFunc(func(w ResponseWriter, r *Message) {
+		calls++
+		w.WriteMsg(signedReply(r))
+	}), StripDNSSEC(), Caching(NewCache(100), nil))
+
+	plain := &testWriter{}
+	h.ServeDNS(plain, testQuery("www.example.com", A, false))
+	if got := recordTypes(plain.replies[0].Answers); !slices.Equal(got, []QuestionType{A}) {
+		t.Errorf("DO=0 answers %v, want [A]", got)
+	}
+
+	signed := &testWriter{}
+	h.ServeDNS(signed, testQuery("www.example.com", A, true))
+	if calls != 1 {
+		t.Errorf("handler called %d times, want the DO=1 query served from the cache", calls)
+	}
+	if got := recordTypes(signed.replies[0].Answers); !slices.Equal(got, []QuestionType{A, RRSIG}) {
+		t.Errorf("DO=1 answers %v, want [A RRSIG]", got)
+	}
+}
+
+func TestResolveQuestionsAlwaysSetsDO(t *testing.T) {
+	for _, do := range []bool{false, true} {
+		query := testQuery("www.example.com", A, do)
+		var asked bool
+		resolveQuestions(query, NewReply(query), time.Second, &Forwarder{},
+			func(ctx context.Context, q *Question, cd, do bool) (*Message, error) {
+				asked = do
+				return signedReply(query), nil
+			})
+		if !asked {
+			t.Errorf("client DO=%t: upstream query sent without DO", do)
+		}
+	}
+}
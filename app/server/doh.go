@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// dohContentType is the media type of DNS wire format messages (RFC 8484 §6)
+const dohContentType = "application/dns-message"
+
+// dohTransport queries an upstream over DNS over HTTPS (RFC 8484), POSTing
+// wire format messages over HTTP/2. Its hostname is resolved through the
+// plain upstreams of the same Forwarder, if there are any, so the server
+// never depends on the system resolver (which may well be itself)
+type dohTransport struct {
+	url    string
+	client *http.Client
+	pool   *ConnPool
+
+	// bootstrap resolves the DoH hostname, set by NewForwarder
+	bootstrap []plainTransport
+}
+
+// newDoHTransport builds a DoH transport posting queries to u, such as
+// https://dns.google/dns-query. HTTP keeps its own idle connections, as
+// HTTP/2 shares one among concurrent queries, but with the limits of pool and
+// dialed through it
+func newDoHTransport(u *url.URL, pool *ConnPool) *dohTransport {
+	t := &dohTransport{url: u.String(), pool: pool}
+	t.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:       t.dial,
+			ForceAttemptHTTP2: true,
+			TLSClientConfig: &tls.Config{
+				ClientSessionCache: tls.NewLRUClientSessionCache(dotSessionCacheSize),
+				MinVersion:         tls.VersionTLS12,
+			},
+			MaxIdleConnsPerHost: pool.maxConnsPerHost,
+			IdleConnTimeout:     pool.idleTimeout,
+		},
+	}
+	return t
+}
+
+func (t *dohTransport) exchange(ctx context.Context, query *Message) (*Message, error) {
+	// The ID is sent as 0 so HTTP caches can share replies (RFC 8484 §4.1)
+	header := *query.Header
+	header.ID = 0
+	wire := *query
+	wire.Header = &header
+
+	packet, err := wire.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(packet))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns: upstream answered HTTP %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohContentType {
+		return nil, fmt.Errorf("dns: upstream answered with content type %q", ct)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxTCPSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxTCPSize {
+		return nil, errors.New("dns: upstream reply too large")
+	}
+
+	reply, err := ParseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	reply.Header.ID = query.Header.ID
+	return reply, nil
+}
+
+// dial connects to the DoH server, resolving its hostname through the
+// bootstrap upstreams
+func (t *dohTransport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil || len(t.bootstrap) == 0 {
+		return t.pool.dial(ctx, dialer(network, addr))
+	}
+
+	ips, err := resolveBootstrap(ctx, t.bootstrap, host)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping %s: %w", host, err)
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = t.pool.dial(ctx, dialer(network, net.JoinHostPort(ip.String(), port))); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveBootstrap looks up the IPv4 and IPv6 addresses of host through the
+// first bootstrap upstream that answers. Fails if neither lookup finds an
+// address, with the last exchange error if there was one
+func resolveBootstrap(ctx context.Context, bootstrap []plainTransport, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var err error
+	for _, qt := range []QuestionType{A, AAAA} {
+		query := NewQuery(randomID(), host, qt, true)
+		for _, b := range bootstrap {
+			var reply *Message
+			if reply, err = b.exchange(ctx, query); err != nil {
+				continue
+			}
+			for _, rr := range reply.Answers {
+				if (rr.Type == A && len(rr.Data) == net.IPv4len) || (rr.Type == AAAA && len(rr.Data) == net.IPv6len) {
+					ips = append(ips, net.IP(rr.Data))
+				}
+			}
+			break
+		}
+	}
+	if len(ips) == 0 {
+		if err != nil {
+			return nil, fmt.Errorf("no address found: %w", err)
+		}
+		return nil, errors.New("no address found")
+	}
+	return ips, nil
+}
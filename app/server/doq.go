@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/quic"
+)
+
+// doqALPN is the ALPN token of DNS over QUIC (RFC 9250 §4.1.1)
+const doqALPN = "doq"
+
+// doqTransport queries an upstream over DNS over QUIC (RFC 9250). A single
+// connection to the upstream is kept open and every query is sent on a stream
+// of its own, so concurrent queries share it without waiting on each other.
+// Like DoH, its hostname is resolved through the plain upstreams of the same
+// Forwarder, if there are any
+type doqTransport struct {
+	addr   string
+	config *quic.Config
+
+	// bootstrap resolves the DoQ hostname, set by NewForwarder
+	bootstrap []plainTransport
+
+	mu       sync.Mutex
+	endpoint *quic.Endpoint
+	conn     *quic.Conn
+}
+
+// newDoQTransport builds a DoQ transport from a URL such as
+// quic://dns.adguard-dns.com?pin=<base64 SHA-256>. The port defaults to 853,
+// see upstreamTLSConfig for the parameters. The connection is closed once it
+// has been idle for the idle timeout of pool
+func newDoQTransport(u *url.URL, pool *ConnPool) (*doqTransport, error) {
+	config, err := upstreamTLSConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	// QUIC only runs over TLS 1.3 (RFC 9001 §4.2)
+	config.MinVersion = tls.VersionTLS13
+	config.NextProtos = []string{doqALPN}
+	return &doqTransport{
+		addr: withDefaultPort(u.Host, "853"),
+		config: &quic.Config{
+			TLSConfig:      config,
+			MaxIdleTimeout: pool.idleTimeout,
+		},
+	}, nil
+}
+
+func (t *doqTransport) exchange(ctx context.Context, query *Message) (*Message, error) {
+	// The ID is sent as 0 (RFC 9250 §4.2.1)
+	header := *query.Header
+	header.ID = 0
+	wire := *query
+	wire.Header = &header
+	packet, err := wire.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, reused, err := t.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := doqExchange(ctx, conn, packet)
+	if err != nil && reused && ctx.Err() == nil {
+		// The upstream may have closed the connection while it sat idle, so
+		// the query is retried once on a new one
+		t.drop(conn)
+		if conn, _, err = t.connection(ctx); err != nil {
+			return nil, err
+		}
+		reply, err = doqExchange(ctx, conn, packet)
+	}
+	if err != nil {
+		t.drop(conn)
+		return nil, err
+	}
+	reply.Header.ID = query.Header.ID
+	return reply, nil
+}
+
+// connection returns the open connection to the upstream, dialing one if there
+// is none. reused reports whether it was already open
+func (t *doqTransport) connection(ctx context.Context) (conn *quic.Conn, reused bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		return t.conn, true, nil
+	}
+	if t.endpoint == nil {
+		// A nil config makes an endpoint that only dials
+		if t.endpoint, err = quic.Listen("udp", ":0", nil); err != nil {
+			return nil, false, err
+		}
+	}
+	if t.conn, err = t.dial(ctx); err != nil {
+		return nil, false, err
+	}
+	return t.conn, false, nil
+}
+
+// dial opens a connection to the upstream, resolving its hostname through the
+// bootstrap upstreams
+func (t *doqTransport) dial(ctx context.Context) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(t.addr)
+	if err != nil || net.ParseIP(host) != nil || len(t.bootstrap) == 0 {
+		return t.endpoint.Dial(ctx, "udp", t.addr, t.config)
+	}
+	ips, err := resolveBootstrap(ctx, t.bootstrap, host)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping %s: %w", host, err)
+	}
+	for _, ip := range ips {
+		var conn *quic.Conn
+		if conn, err = t.endpoint.Dial(ctx, "udp", net.JoinHostPort(ip.String(), port), t.config); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// drop closes conn and forgets it if it is still the open connection
+func (t *doqTransport) drop(conn *quic.Conn) {
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.mu.Unlock()
+	conn.Abort(nil)
+}
+
+// doqExchange sends packet on a new stream of conn and reads the reply from it.
+// Messages are prefixed with their length as over TCP, and the stream is
+// closed for writing once the query is sent (RFC 9250 §4.2)
+func doqExchange(ctx context.Context, conn *quic.Conn, packet []byte) (*Message, error) {
+	stream, err := conn.NewStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	stream.SetReadContext(ctx)
+	stream.SetWriteContext(ctx)
+
+	if _, err := stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...)); err != nil {
+		return nil, err
+	}
+	stream.CloseWrite()
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, raw); err != nil {
+		return nil, err
+	}
+	return ParseMessage(raw)
+}
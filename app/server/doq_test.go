@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 and a pool
+// trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+// serveDoQ answers the queries on every stream of conn with an A record,
+// failing the test if a query does not have ID 0
+func serveDoQ(t *testing.T, conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			raw, err := io.ReadAll(stream)
+			if err != nil || len(raw) < 2 {
+				return
+			}
+			query, err := ParseMessage(raw[2:])
+			if err != nil {
+				return
+			}
+			if query.Header.ID != 0 {
+				t.Errorf("query sent with ID %d, want 0", query.Header.ID)
+			}
+			reply := NewReply(query)
+			reply.Answers = []*ResourceRecord{NewARecord(query.Questions[0].Name, net.IPv4(192, 0, 2, 1), 300)}
+			packet, err := reply.Marshal()
+			if err != nil {
+				return
+			}
+			stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...))
+		}()
+	}
+}
+
+func TestDoQTransport(t *testing.T) {
+	cert, roots := testCertificate(t)
+	listener, err := quic.Listen("udp", "127.0.0.1:0", &quic.Config{
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{doqALPN},
+			MinVersion:   tls.VersionTLS13,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close(context.Background())
+
+	accepted := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go serveDoQ(t, conn)
+		}
+	}()
+
+	u, _ := url.Parse("quic://" + listener.LocalAddr().String())
+	transport, err := newDoQTransport(u, NewConnPool(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.config.TLSConfig.RootCAs = roots
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		query := NewQuery(randomID(), name, A, true)
+		reply, err := transport.exchange(ctx, query)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if reply.Header.ID != query.Header.ID {
+			t.Errorf("%s: reply ID %d, want the query's %d", name, reply.Header.ID, query.Header.ID)
+		}
+		if len(reply.Answers) != 1 || reply.Answers[0].Name != name {
+			t.Errorf("%s: unexpected reply %v", name, reply)
+		}
+	}
+	if n := len(accepted); n != 1 {
+		t.Errorf("%d connections opened, want the first one reused", n)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// dotSessionCacheSize is how many TLS sessions are kept for resumption
+const dotSessionCacheSize = 16
+
+// dotTransport queries an upstream over DNS over TLS (RFC 7858). Connections
+// are kept open in the pool and reused for later queries, and TLS sessions
+// are resumed when a new connection is needed
+type dotTransport struct {
+	addr   string
+	config *tls.Config
+	pool   *ConnPool
+}
+
+// newDoTTransport builds a DoT transport from a URL such as
+// tls://1.1.1.1?sni=cloudflare-dns.com&pin=<base64 SHA-256>. The port
+// defaults to 853, see upstreamTLSConfig for the parameters
+func newDoTTransport(u *url.URL, pool *ConnPool) (*dotTransport, error) {
+	config, err := upstreamTLSConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	return &dotTransport{
+		addr:   withDefaultPort(u.Host, "853"),
+		config: config,
+		pool:   pool,
+	}, nil
+}
+
+// upstreamTLSConfig builds the TLS configuration for an encrypted upstream
+// from its URL. The SNI defaults to the URL host and can be set with the sni
+// parameter. Each pin parameter is the hash of an accepted
+// SubjectPublicKeyInfo (RFC 7469); if any are given the upstream's
+// certificate must match one of them on top of normal verification
+func upstreamTLSConfig(u *url.URL) (*tls.Config, error) {
+	query := u.Query()
+	sni := query.Get("sni")
+	if sni == "" {
+		sni = u.Hostname()
+	}
+
+	var pins [][]byte
+	for _, pin := range query["pin"] {
+		// An unescaped '+' of the base64 pin decodes as a space
+		hash, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(pin, " ", "+"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("dns: invalid SPKI pin %q", pin)
+		}
+		pins = append(pins, hash)
+	}
+
+	config := &tls.Config{
+		ServerName:         sni,
+		ClientSessionCache: tls.NewLRUClientSessionCache(dotSessionCacheSize),
+		MinVersion:         tls.VersionTLS12,
+	}
+	if len(pins) > 0 {
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+	return config, nil
+}
+
+// verifyPins checks that the leaf certificate's public key matches one of pins
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("dns: upstream sent no certificate")
+	}
+	hash := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(hash[:], pin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("dns: upstream public key %s matches no pin", base64.StdEncoding.EncodeToString(hash[:]))
+}
+
+func (t *dotTransport) exchange(ctx context.Context, query *Message) (*Message, error) {
+	raw, err := t.pool.exchange(ctx, "tls://"+t.addr, t.dial, query)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMessage(raw)
+}
+
+// dial opens a new TLS connection to the upstream
+func (t *dotTransport) dial(ctx context.Context) (net.Conn, error) {
+	d := tls.Dialer{
+		NetDialer: &net.Dialer{},
+		Config:    t.config,
+	}
+	return d.DialContext(ctx, "tcp", t.addr)
+}
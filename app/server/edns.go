@@ -0,0 +1,165 @@
+package server
+
+import "encoding/binary"
+
+// EDNS(0) support (RFC 6891). The OPT pseudo-record travels in the additional
+// section: its CLASS holds the sender's UDP payload size and its TTL the
+// extended RCODE, version and DO bit
+
+// maxUDPReadSize is the size of the UDP read buffer, large enough for any
+// datagram so EDNS queries are never cut short
+const maxUDPReadSize = 65535
+
+// ednsVersion is the highest EDNS version the server implements. NewOPT
+// records advertise it, as its bits of the OPT TTL are left zero
+const ednsVersion = 0
+
+// ednsUDPSize is the UDP payload size the server advertises in its own OPT
+// record, and the most it sends over UDP whatever a client advertises
+const ednsUDPSize = 4096
+
+// NewOPT builds an OPT record advertising udpSize, with no options set
+func NewOPT(udpSize uint16) *ResourceRecord {
+	return &ResourceRecord{
+		Name:  "",
+		Type:  OPT,
+		Class: udpSize,
+	}
+}
+
+// OPT returns the message's OPT record, or nil if the sender does not use EDNS
+func (m *Message) OPT() *ResourceRecord {
+	for _, rr := range m.Additionals {
+		if rr.Type == OPT {
+			return rr
+		}
+	}
+	return nil
+}
+
+// UDPSize returns the largest UDP message the sender of m accepts: the payload
+// size advertised in its OPT record, or 512 without EDNS. Advertised sizes
+// below 512 are treated as 512 (RFC 6891 §6.2.5)
+func (m *Message) UDPSize() int {
+	opt := m.OPT()
+	if opt == nil {
+		return maxUDPSize
+	}
+	return max(int(opt.Class), maxUDPSize)
+}
+
+// The OPT record's TTL holds, from the most significant byte, the upper 8 bits
+// of the extended RCODE, the EDNS version and a 16 bit flags field whose top
+// bit is DO (RFC 6891 §6.1.3)
+
+// optExtendedRCode returns the upper 8 bits of the extended RCODE
+func optExtendedRCode(opt *ResourceRecord) uint8 {
+	return uint8(opt.TTL >> 24)
+}
+
+// optVersion returns the EDNS version of the sender
+func optVersion(opt *ResourceRecord) uint8 {
+	return uint8(opt.TTL >> 16)
+}
+
+// optDO reports whether the DNSSEC OK bit is set (RFC 3225)
+func optDO(opt *ResourceRecord) bool {
+	return opt.TTL&0x8000 != 0
+}
+
+// setOptDO sets or clears the DNSSEC OK bit
+func setOptDO(opt *ResourceRecord, do bool) {
+	opt.TTL &^= 0x8000
+	if do {
+		opt.TTL |= 0x8000
+	}
+}
+
+// dnssecOK reports whether the sender of m asked for DNSSEC records with the
+// DO bit of its OPT record
+func dnssecOK(m *Message) bool {
+	opt := m.OPT()
+	return opt != nil && optDO(opt)
+}
+
+// RCode returns the 12 bit response code of the message: the header's 4 bits,
+// extended by the upper 8 bits from the OPT record if there is one
+func (m *Message) RCode() RCode {
+	rcode := m.Header.Flag.GetRCode()
+	if opt := m.OPT(); opt != nil {
+		rcode |= RCode(optExtendedRCode(opt)) << 4
+	}
+	return rcode
+}
+
+// SetRCode sets the 12 bit response code of the message, splitting it between
+// the header and the OPT record. An OPT record is added if an extended RCODE
+// needs one
+func (m *Message) SetRCode(rcode RCode) {
+	m.Header.Flag.SetRCode(rcode)
+
+	opt := m.OPT()
+	if opt == nil {
+		if rcode <= 0x0F {
+			return
+		}
+		opt = NewOPT(ednsUDPSize)
+		m.Additionals = append(m.Additionals, opt)
+	}
+	opt.TTL = opt.TTL&0x00FFFFFF | uint32(rcode>>4&0xFF)<<24
+}
+
+// The OPT record's RDATA is a list of options, each a 16 bit code and length
+// followed by that many bytes of data
+
+// ednsOptionEDE is the option code of Extended DNS Errors (RFC 8914)
+const ednsOptionEDE = 15
+
+// Extended DNS Error info codes (RFC 8914 §4) the server sends
+const (
+	EDEBlocked              uint16 = 15 // The name is blocked by local policy
+	EDENoReachableAuthority uint16 = 22 // No upstream or authority answered
+)
+
+// edeNames are the names dig shows for the EDE info codes the server sends
+var edeNames = map[uint16]string{
+	EDEBlocked:              "Blocked",
+	EDENoReachableAuthority: "No Reachable Authority",
+}
+
+// SetExtendedError attaches an Extended DNS Error explaining the reply's
+// rcode, with text for humans. It travels in the OPT record, so nothing is
+// attached if the client does not use EDNS
+func (m *Message) SetExtendedError(code uint16, text string) {
+	m.extendedError = code
+	opt := m.OPT()
+	if opt == nil {
+		return
+	}
+	data := binary.BigEndian.AppendUint16(nil, code)
+	opt.Data = appendEDNSOption(opt.Data, ednsOptionEDE, append(data, text...))
+}
+
+// appendEDNSOption appends an option with code and data to OPT RDATA buf
+func appendEDNSOption(buf []byte, code uint16, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, code)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+	return append(buf, data...)
+}
+
+// optOptions returns the data of every option with code in opt, skipping a
+// truncated trailing option
+func optOptions(opt *ResourceRecord, code uint16) [][]byte {
+	var options [][]byte
+	for data := opt.Data; len(data) >= 4; {
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			break
+		}
+		if binary.BigEndian.Uint16(data) == code {
+			options = append(options, data[4:4+length])
+		}
+		data = data[4+length:]
+	}
+	return options
+}
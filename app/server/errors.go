@@ -0,0 +1,19 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTruncated is returned by the parsing functions when a read would run past
+// the end of the buffer
+var ErrTruncated = errors.New("dns: message truncated")
+
+// need returns an error wrapping ErrTruncated if n bytes cannot be read from
+// buf at offset
+func need(buf []byte, offset int, n int, what string) error {
+	if offset < 0 || n < 0 || offset+n > len(buf) {
+		return fmt.Errorf("%w: %s needs %d bytes at offset %d, have %d", ErrTruncated, what, n, offset, len(buf))
+	}
+	return nil
+}
@@ -29,6 +29,11 @@ const (
 	RCodeNXRRSet  RCode = 8  // RR Set that should exist does not
 	RCodeNotAuth  RCode = 9  // Server not authoritative for zone / not authorized
 	RCodeNotZone  RCode = 10 // Name not contained in zone
+
+	// Extended RCODEs do not fit the header's 4 bits and need an OPT record
+	// to carry their upper 8 bits (RFC 6891 §6.1.3), see Message.RCode
+	RCodeBadVers   RCode = 16 // Bad OPT version
+	RCodeBadCookie RCode = 23 // Bad or missing server cookie (RFC 7873)
 )
 
 func NewFlag(bt []byte) *Flag {
@@ -41,14 +46,15 @@ func (f *Flag) SetQR(flag bool) {
 	if flag {
 		f.flagByte[0] |= (1 << 7)
 	} else {
-		f.flagByte[0] ^= 0x80
+		f.flagByte[0] &^= (1 << 7)
 	}
 }
 func (f Flag) GetOPCode() OPCode {
-	return OPCode(f.flagByte[0] >> 4 & 0x07)
+	return OPCode(f.flagByte[0] >> 3 & 0x0F)
 }
 func (f *Flag) SetOPCode(opcode OPCode) {
-	f.flagByte[0] |= (byte(opcode) << 3)
+	f.flagByte[0] &^= 0x78
+	f.flagByte[0] |= (byte(opcode) & 0x0F) << 3
 }
 func (f Flag) GetAA() bool {
 	return f.flagByte[0]&(1<<2) != 0
@@ -57,7 +63,7 @@ func (f *Flag) SetAA(flag bool) {
 	if flag {
 		f.flagByte[0] |= (1 << 2)
 	} else {
-		f.flagByte[0] ^= 0x04
+		f.flagByte[0] &^= (1 << 2)
 	}
 }
 func (f Flag) GetTC() bool {
@@ -67,7 +73,7 @@ func (f *Flag) SetTC(flag bool) {
 	if flag {
 		f.flagByte[0] |= (1 << 1)
 	} else {
-		f.flagByte[0] ^= 0x02
+		f.flagByte[0] &^= (1 << 1)
 	}
 }
 func (f Flag) GetRD() bool {
@@ -75,9 +81,9 @@ func (f Flag) GetRD() bool {
 }
 func (f *Flag) SetRD(flag bool) {
 	if flag {
-		f.flagByte[0] |= (1 << 1)
+		f.flagByte[0] |= (1 << 0)
 	} else {
-		f.flagByte[0] ^= 0x01
+		f.flagByte[0] &^= (1 << 0)
 	}
 }
 func (f Flag) GetRA() bool {
@@ -87,7 +93,7 @@ func (f *Flag) SetRA(flag bool) {
 	if flag {
 		f.flagByte[1] |= (1 << 7)
 	} else {
-		f.flagByte[1] ^= 0x80
+		f.flagByte[1] &^= (1 << 7)
 	}
 }
 func (f Flag) GetZ() byte {
@@ -97,9 +103,32 @@ func (f *Flag) SetZ(b byte) {
 	f.flagByte[1] &= 0x8f
 	f.flagByte[1] |= b << 4
 }
+func (f Flag) GetAD() bool {
+	return f.flagByte[1]&(1<<5) != 0
+}
+func (f *Flag) SetAD(flag bool) {
+	if flag {
+		f.flagByte[1] |= (1 << 5)
+	} else {
+		f.flagByte[1] &^= (1 << 5)
+	}
+}
+
+// GetCD reports whether the Checking Disabled bit (RFC 4035 §3.2.2) is set,
+// meaning the client asked us not to perform DNSSEC validation on its behalf
+func (f Flag) GetCD() bool {
+	return f.flagByte[1]&(1<<4) != 0
+}
+func (f *Flag) SetCD(flag bool) {
+	if flag {
+		f.flagByte[1] |= (1 << 4)
+	} else {
+		f.flagByte[1] &^= (1 << 4)
+	}
+}
 func (f Flag) GetRCode() RCode {
 	return RCode(f.flagByte[1] & 0x0F)
 }
 func (f *Flag) SetRCode(rcode RCode) {
-	f.flagByte[1] = f.flagByte[1] & (0xF0 + byte(rcode))
+	f.flagByte[1] = f.flagByte[1]&0xF0 | byte(rcode)&0x0F
 }
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// String returns the mnemonic of the opcode as printed by dig
+func (o OPCode) String() string {
+	switch o {
+	case QUERY:
+		return "QUERY"
+	case IQUERY:
+		return "IQUERY"
+	case STATUS:
+		return "STATUS"
+	case NOTIFY:
+		return "NOTIFY"
+	case UPDATE:
+		return "UPDATE"
+	default:
+		return fmt.Sprintf("OPCODE%d", uint8(o))
+	}
+}
+
+// String returns the mnemonic of the response code as printed by dig
+func (r RCode) String() string {
+	switch r {
+	case RCodeNoError:
+		return "NOERROR"
+	case RCodeFormErr:
+		return "FORMERR"
+	case RCodeServFail:
+		return "SERVFAIL"
+	case RCodeNXDomain:
+		return "NXDOMAIN"
+	case RCodeNotImp:
+		return "NOTIMP"
+	case RCodeRefused:
+		return "REFUSED"
+	case RCodeYXDomain:
+		return "YXDOMAIN"
+	case RCodeYXRRSet:
+		return "YXRRSET"
+	case RCodeNXRRSet:
+		return "NXRRSET"
+	case RCodeNotAuth:
+		return "NOTAUTH"
+	case RCodeNotZone:
+		return "NOTZONE"
+	case RCodeBadVers:
+		return "BADVERS"
+	case RCodeBadCookie:
+		return "BADCOOKIE"
+	default:
+		return fmt.Sprintf("RCODE%d", uint16(r))
+	}
+}
+
+// String renders the set flags in dig order, e.g. "qr rd ra"
+func (f Flag) String() string {
+	var flags []string
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", f.GetQR()},
+		{"aa", f.GetAA()},
+		{"tc", f.GetTC()},
+		{"rd", f.GetRD()},
+		{"ra", f.GetRA()},
+		{"ad", f.GetAD()},
+		{"cd", f.GetCD()},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
+// String renders the header the way dig prints it
+func (h Header) String() string {
+	return h.format(h.Flag.GetRCode())
+}
+
+// format renders the header with the given status, which for messages with
+// an OPT record is the full extended RCODE rather than the header's 4 bits
+func (h Header) format(rcode RCode) string {
+	return fmt.Sprintf(";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n;; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d",
+		h.Flag.GetOPCode(), rcode, h.ID,
+		h.Flag, h.QDCount, h.ANCount, h.NSCount, h.ARCount)
+}
+
+// String renders the question as a dig question section line
+func (q Question) String() string {
+	return fmt.Sprintf(";%s\t\t%s\t%s", fqdn(q.Name), ClassString(q.Class), q.Type)
+}
+
+// String renders the record in zone file presentation format as dig does
+func (rr ResourceRecord) String() string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", fqdn(rr.Name), rr.TTL, ClassString(rr.Class), rr.Type, rr.DataString())
+}
+
+// DataString renders the RDATA in presentation format for the types the
+// server understands, falling back to the generic RFC 3597 form for other
+// types or RDATA that cannot be decoded on its own
+func (rr *ResourceRecord) DataString() string {
+	switch rr.Type {
+	case A:
+		if len(rr.Data) == net.IPv4len {
+			return net.IP(rr.Data).String()
+		}
+	case AAAA:
+		if len(rr.Data) == net.IPv6len {
+			return net.IP(rr.Data).String()
+		}
+	case NS, CNAME, PTR, MD, MF, MB, MG, MR:
+		if name, end, err := ParseDomainName(rr.Data, 0); err == nil && end == len(rr.Data) {
+			return fqdn(name)
+		}
+	case MX:
+		if len(rr.Data) > 2 {
+			if name, end, err := ParseDomainName(rr.Data, 2); err == nil && end == len(rr.Data) {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(rr.Data[:2]), fqdn(name))
+			}
+		}
+	case TXT:
+		if s, ok := txtString(rr.Data); ok {
+			return s
+		}
+	case SOA:
+		if s, ok := soaString(rr.Data); ok {
+			return s
+		}
+	}
+	return rr.GenericData()
+}
+
+// String renders the whole message in dig output format
+func (m Message) String() string {
+	var b strings.Builder
+
+	header := *m.Header
+	header.QDCount = uint16(len(m.Questions))
+	header.ANCount = uint16(len(m.Answers))
+	header.NSCount = uint16(len(m.Authorities))
+	header.ARCount = uint16(len(m.Additionals))
+	b.WriteString(header.format(m.RCode()))
+	b.WriteString("\n")
+
+	// dig lists the OPT record in a pseudosection of its own
+	var additionals []*ResourceRecord
+	for _, rr := range m.Additionals {
+		if rr.Type != OPT {
+			additionals = append(additionals, rr)
+			continue
+		}
+		b.WriteString("\n;; OPT PSEUDOSECTION:\n")
+		fmt.Fprintf(&b, "; EDNS: version: %d, flags:", optVersion(rr))
+		if optDO(rr) {
+			b.WriteString(" do")
+		}
+		fmt.Fprintf(&b, "; udp: %d\n", rr.Class)
+		for _, ede := range optOptions(rr, ednsOptionEDE) {
+			if len(ede) < 2 {
+				continue
+			}
+			code := binary.BigEndian.Uint16(ede)
+			fmt.Fprintf(&b, "; EDE: %d", code)
+			if name, ok := edeNames[code]; ok {
+				fmt.Fprintf(&b, " (%s)", name)
+			}
+			if len(ede) > 2 {
+				fmt.Fprintf(&b, ": (%s)", ede[2:])
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	if len(m.Questions) > 0 {
+		b.WriteString("\n;; QUESTION SECTION:\n")
+		for _, q := range m.Questions {
+			b.WriteString(q.String())
+			b.WriteString("\n")
+		}
+	}
+
+	for _, section := range []struct {
+		name    string
+		records []*ResourceRecord
+	}{
+		{"ANSWER", m.Answers},
+		{"AUTHORITY", m.Authorities},
+		{"ADDITIONAL", additionals},
+	} {
+		if len(section.records) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n;; %s SECTION:\n", section.name)
+		for _, rr := range section.records {
+			b.WriteString(rr.String())
+			b.WriteString("\n")
+		}
+	}
+
+	return b.String()
+}
+
+// fqdn returns name with a trailing dot, as names are printed by dig
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// txtString renders TXT RDATA as a list of quoted character strings
+func txtString(data []byte) (string, bool) {
+	var parts []string
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		offset++
+		if offset+length > len(data) {
+			return "", false
+		}
+		parts = append(parts, fmt.Sprintf("%q", data[offset:offset+length]))
+		offset += length
+	}
+	return strings.Join(parts, " "), true
+}
+
+// soaString renders SOA RDATA as "mname rname serial refresh retry expire minimum"
+func soaString(data []byte) (string, bool) {
+	mname, offset, err := ParseDomainName(data, 0)
+	if err != nil {
+		return "", false
+	}
+	rname, offset, err := ParseDomainName(data, offset)
+	if err != nil || offset+20 != len(data) {
+		return "", false
+	}
+	return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(mname), fqdn(rname),
+		binary.BigEndian.Uint32(data[offset:]),
+		binary.BigEndian.Uint32(data[offset+4:]),
+		binary.BigEndian.Uint32(data[offset+8:]),
+		binary.BigEndian.Uint32(data[offset+12:]),
+		binary.BigEndian.Uint32(data[offset+16:])), true
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultForwardTimeout bounds how long a client query waits on the upstream
+const defaultForwardTimeout = 3 * time.Second
+
+// Forwarder is a Handler that resolves queries through upstream resolvers.
+// Each question is sent upstream as a query of its own and the answers are
+// merged back into a single reply carrying the client's ID. The fastest
+// healthy upstream is tried first, failing over to the others when it is down
+type Forwarder struct {
+	upstreams []*upstream
+	// Retry policy, see retry.go. timeout bounds a client query over every
+	// round, attemptTimeout a single query to one upstream
+	timeout        time.Duration
+	attemptTimeout time.Duration
+	retries        int
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	// race is how many upstreams each query is sent to at once, see
+	// WithRace
+	race int
+	// delegations are child zones sent to their own servers, see
+	// delegation.go
+	delegations []*delegation
+	// pool holds the connections of every upstream transport
+	pool *ConnPool
+	// err is the first invalid option, returned by NewForwarder
+	err error
+}
+
+// ForwarderOption configures optional Forwarder behaviour
+type ForwarderOption func(*Forwarder)
+
+// WithRace sends every query to the n fastest healthy upstreams at once and
+// uses the first valid reply, cancelling the others. This trades upstream load
+// for lower latency when upstreams vary a lot. n of 1 or less disables it
+func WithRace(n int) ForwarderOption {
+	return func(f *Forwarder) {
+		f.race = n
+	}
+}
+
+// WithConnPool keeps up to maxConnsPerHost TCP or TLS connections open to
+// each upstream, closing them once idle for idleTimeout
+func WithConnPool(maxConnsPerHost int, idleTimeout time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.pool.maxConnsPerHost = maxConnsPerHost
+		f.pool.idleTimeout = idleTimeout
+	}
+}
+
+// NewForwarder builds a Forwarder sending queries to the upstreams at addrs.
+// Each is a host:port such as 8.8.8.8:53, a tls:// URL for DNS over TLS such
+// as tls://1.1.1.1?sni=cloudflare-dns.com, an https:// URL for DNS over
+// HTTPS such as https://dns.google/dns-query or a quic:// URL for DNS over
+// QUIC such as quic://dns.adguard-dns.com. DoH and DoQ hostnames are resolved
+// through the plain upstreams. Until their latency is known upstreams are
+// preferred in order
+func NewForwarder(addrs []string, opts ...ForwarderOption) (*Forwarder, error) {
+	f := &Forwarder{
+		timeout:        defaultForwardTimeout,
+		attemptTimeout: upstreamAttemptTimeout,
+		retries:        defaultRetries,
+		backoff:        defaultRetryBackoff,
+		maxBackoff:     defaultMaxRetryBackoff,
+		pool:           NewConnPool(defaultMaxConnsPerHost, defaultPoolIdleTimeout),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	var plain []plainTransport
+	for _, addr := range addrs {
+		t, err := newTransport(addr, f.pool)
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := t.(plainTransport); ok {
+			plain = append(plain, p)
+		}
+		f.upstreams = append(f.upstreams, &upstream{addr: addr, transport: t})
+	}
+	for _, u := range f.upstreams {
+		switch t := u.transport.(type) {
+		case *dohTransport:
+			t.bootstrap = plain
+		case *doqTransport:
+			t.bootstrap = plain
+		}
+	}
+	return f, nil
+}
+
+// PoolStats returns the counters of the upstream connection pool
+func (f *Forwarder) PoolStats() PoolStats {
+	return f.pool.Stats()
+}
+
+// WithResolver replaces the server's static answers with forwarding through
+// f. The upstreams are probed during warm-up
+func WithResolver(f *Forwarder) Option {
+	return func(s *DNSServer) {
+		s.handler = f
+		s.forwarder = f
+		s.warmup = append(s.warmup, f.Probe)
+	}
+}
+
+func (f *Forwarder) String() string {
+	addrs := make([]string, len(f.upstreams))
+	for i, u := range f.upstreams {
+		addrs[i] = u.addr
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// ServeDNS forwards the questions of r and replies with the merged answers.
+// Queries with RD unset are not forwarded and get an empty reply: they may
+// only be answered from local data, and the cache in front of the forwarder
+// had none for them
+func (f *Forwarder) ServeDNS(w ResponseWriter, r *Message) {
+	reply := NewReply(r)
+	reply.Header.Flag.SetRA(true)
+
+	switch {
+	case r.Header.Flag.GetOPCode() != QUERY:
+		// Only standard queries are supported
+		reply.SetRCode(RCodeNotImp)
+	case r.Header.Flag.GetRD():
+		f.forward(r, reply)
+	}
+
+	if err := w.WriteMsg(reply); err != nil {
+		fmt.Printf("Failed to reply to %s: %v\n", w.RemoteAddr(), err)
+	}
+}
+
+// forward resolves every question of r through the upstreams and merges the
+// replies into reply, see resolveQuestions
+func (f *Forwarder) forward(r *Message, reply *Message) {
+	resolveQuestions(r, reply, f.timeout, f, f.Resolve)
+}
+
+// resolveQuestions resolves every question of r concurrently with resolve,
+// within timeout, and merges the replies into reply. If any question fails
+// the reply is SERVFAIL with an Extended DNS Error saying why, and the
+// failure is logged naming via; otherwise it carries the first non-NOERROR
+// rcode, in question order
+func resolveQuestions(r, reply *Message, timeout time.Duration, via fmt.Stringer,
+	resolve func(ctx context.Context, q *Question, cd, do bool) (*Message, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	replies := make([]*Message, len(r.Questions))
+	errs := make([]error, len(r.Questions))
+	var wg sync.WaitGroup
+	for i, q := range r.Questions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// DNSSEC records are always asked for so cached replies can serve
+			// clients with and without DO, see StripDNSSEC
+			replies[i], errs[i] = resolve(ctx, q, r.Header.Flag.GetCD(), true)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			fmt.Printf("Failed to resolve %s %s via %s: %v\n", r.Questions[i].Name, r.Questions[i].Type, via, err)
+			reply.SetRCode(RCodeServFail)
+			reply.SetExtendedError(EDENoReachableAuthority, extendedErrorText(err))
+			return
+		}
+	}
+
+	for _, upstream := range replies {
+		if rcode := upstream.RCode(); rcode != RCodeNoError && reply.RCode() == RCodeNoError {
+			reply.SetRCode(rcode)
+		}
+		reply.Answers = append(reply.Answers, upstream.Answers...)
+		reply.Authorities = append(reply.Authorities, upstream.Authorities...)
+		for _, rr := range upstream.Additionals {
+			// The client gets the server's own OPT record from NewReply
+			if rr.Type != OPT {
+				reply.Additionals = append(reply.Additionals, rr)
+			}
+		}
+	}
+}
+
+// Resolve sends a single question to the healthy upstreams, fastest first,
+// failing over to the next one when an upstream times out or answers
+// SERVFAIL. If every upstream is down they are all tried anyway, and if none
+// answers further rounds are made as set by WithRetries. cd sets the
+// Checking Disabled bit of the upstream query and do its DNSSEC OK bit
+func (f *Forwarder) Resolve(ctx context.Context, q *Question, cd, do bool) (*Message, error) {
+	f.probeDue()
+
+	return f.resolveRetrying(ctx, func() (*Message, error) {
+		// Names under a delegation bypass the upstreams entirely
+		if d := f.delegationFor(q.Name); d != nil {
+			servers, err := d.resolveServers(ctx, f)
+			if err != nil {
+				return nil, fmt.Errorf("delegation %s: %w", d.zone, err)
+			}
+			return f.resolveFrom(ctx, orderUpstreams(servers), q, cd, do)
+		}
+
+		upstreams := orderUpstreams(f.upstreams)
+		if n := min(f.race, len(upstreams)); n > 1 {
+			reply, err := f.resolveRace(ctx, upstreams[:n], q, cd, do)
+			if err == nil || ctx.Err() != nil {
+				return reply, err
+			}
+			upstreams = upstreams[n:]
+		}
+		return f.resolveFrom(ctx, upstreams, q, cd, do)
+	})
+}
+
+// extendedErrorText explains a resolution failure to the client without the
+// upstream addresses and socket errors the log gets
+func extendedErrorText(err error) string {
+	var exhausted *exhaustedError
+	if errors.As(err, &exhausted) {
+		if exhausted.expired {
+			return fmt.Sprintf("no upstream answered before the deadline, %d rounds tried", exhausted.rounds)
+		}
+		return fmt.Sprintf("no upstream answered, %d rounds tried", exhausted.rounds)
+	}
+	return "no upstream answered"
+}
+
+// resolveFrom sends a single question to upstreams in turn until one answers
+func (f *Forwarder) resolveFrom(ctx context.Context, upstreams []*upstream, q *Question, cd, do bool) (*Message, error) {
+	err := fmt.Errorf("dns: no upstream configured")
+	for _, u := range upstreams {
+		var reply *Message
+		if reply, err = f.resolveWith(ctx, u, q, cd, do); err == nil {
+			u.markUp()
+			return reply, nil
+		}
+		// The client gave up, which says nothing about the upstream
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		u.markDown(err)
+	}
+	return nil, err
+}
+
+// resolveRace sends a single question to all of upstreams at once and returns
+// the first valid reply, cancelling the queries still outstanding. Returns the
+// last error if none of them answers
+func (f *Forwarder) resolveRace(ctx context.Context, upstreams []*upstream, q *Question, cd, do bool) (*Message, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		u     *upstream
+		reply *Message
+		err   error
+	}
+	results := make(chan result, len(upstreams))
+	for _, u := range upstreams {
+		go func() {
+			reply, err := f.resolveWith(raceCtx, u, q, cd, do)
+			results <- result{u, reply, err}
+		}()
+	}
+
+	var err error
+	for range upstreams {
+		r := <-results
+		if r.err == nil {
+			r.u.markUp()
+			return r.reply, nil
+		}
+		err = r.err
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		r.u.markDown(err)
+	}
+	return nil, err
+}
+
+// orderUpstreams returns upstreams in the order to try them: healthy ones by
+// smoothed RTT, unmeasured ones first, then those that are down. Now and then
+// a random healthy upstream is moved to the front to keep measuring it
+func orderUpstreams(upstreams []*upstream) []*upstream {
+	var healthy, down []*upstream
+	for _, u := range upstreams {
+		if u.healthy() {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+
+	rtts := make(map[*upstream]time.Duration, len(healthy))
+	for _, u := range healthy {
+		rtts[u] = u.smoothedRTT()
+	}
+	slices.SortStableFunc(healthy, func(a, b *upstream) int {
+		return cmp.Compare(rtts[a], rtts[b])
+	})
+
+	if len(healthy) > 1 && rand.Float64() < upstreamExploreRate {
+		i := 1 + rand.IntN(len(healthy)-1)
+		healthy[0], healthy[i] = healthy[i], healthy[0]
+	}
+	return append(healthy, down...)
+}
+
+// resolveWith sends a single question to u and checks the reply answers it
+func (f *Forwarder) resolveWith(ctx context.Context, u *upstream, q *Question, cd, do bool) (*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.attemptTimeout)
+	defer cancel()
+
+	query := NewQuery(randomID(), q.Name, q.Type, true)
+	query.Questions[0].Class = q.Class
+	query.Header.Flag.SetCD(cd)
+	setOptDO(query.OPT(), do)
+
+	start := time.Now()
+	reply, err := u.transport.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	u.observe(time.Since(start))
+
+	if len(reply.Questions) != 1 || CanonicalName(reply.Questions[0].Name) != CanonicalName(q.Name) ||
+		reply.Questions[0].Type != q.Type {
+		return nil, fmt.Errorf("dns: upstream reply does not match the question")
+	}
+	if reply.RCode() == RCodeServFail {
+		return nil, fmt.Errorf("dns: upstream answered SERVFAIL")
+	}
+	return reply, nil
+}
+
+// probeQuestion is sent to check an upstream is answering
+var probeQuestion = &Question{Name: ".", Type: NS, Class: 1}
+
+// probeDue starts a background health probe of every upstream that is down
+// and whose backoff window has passed
+func (f *Forwarder) probeDue() {
+	now := time.Now()
+	for _, u := range f.upstreams {
+		if !u.claimProbe(now) {
+			continue
+		}
+		go func() {
+			defer u.probeDone()
+			if _, err := f.resolveWith(context.Background(), u, probeQuestion, false, false); err != nil {
+				u.markDown(err)
+				return
+			}
+			u.markUp()
+		}()
+	}
+}
+
+// Probe is a WarmupStep checking that every upstream answers queries. Those
+// that do not are marked down
+func (f *Forwarder) Probe(ctx context.Context) error {
+	var errs []error
+	for _, u := range f.upstreams {
+		if _, err := f.resolveWith(ctx, u, probeQuestion, false, false); err != nil {
+			u.markDown(err)
+			errs = append(errs, fmt.Errorf("probing upstream %s: %w", u, err))
+			continue
+		}
+		u.markUp()
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,94 @@
+package server
+
+import "net"
+
+// Handler responds to a DNS query. It is modelled after net/http: the server
+// parses each query and calls ServeDNS, which sends its answer through w
+type Handler interface {
+	ServeDNS(w ResponseWriter, r *Message)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(w ResponseWriter, r *Message)
+
+// ServeDNS calls f(w, r)
+func (f HandlerFunc) ServeDNS(w ResponseWriter, r *Message) {
+	f(w, r)
+}
+
+// ResponseWriter is used by a Handler to reply to the client that sent the
+// query
+type ResponseWriter interface {
+	// WriteMsg marshals and sends a reply
+	WriteMsg(m *Message) error
+	// LocalAddr returns the address the query was received on
+	LocalAddr() net.Addr
+	// RemoteAddr returns the address of the client
+	RemoteAddr() net.Addr
+	// Network returns the transport the query arrived over, e.g. "udp"
+	Network() string
+}
+
+// WithHandler replaces the server's built-in static answers with h
+func WithHandler(h Handler) Option {
+	return func(s *DNSServer) {
+		s.handler = h
+	}
+}
+
+// NewReply builds an empty reply to request: the ID, opcode and questions are
+// echoed, QR is set, the RD and CD bits are copied from the query and an OPT
+// record is added if the query had one, with its DO bit
+func NewReply(request *Message) *Message {
+	header := &Header{
+		ID:   request.Header.ID,
+		Flag: NewFlag([]byte{0x00, 0x00}),
+	}
+	header.Flag.SetQR(true)
+	header.Flag.SetOPCode(request.Header.Flag.GetOPCode())
+	// Checking Disabled must be echoed back so validating stubs know the
+	// answer was not validated on their behalf
+	header.Flag.SetCD(request.Header.Flag.GetCD())
+	// RD is copied from the query (RFC 1035 §4.1.1)
+	header.Flag.SetRD(request.Header.Flag.GetRD())
+
+	reply := &Message{
+		Header:    header,
+		Questions: request.Questions,
+	}
+	// EDNS clients get an OPT record back advertising the server's own
+	// payload size (RFC 6891 §7)
+	if request.OPT() != nil {
+		opt := NewOPT(ednsUDPSize)
+		// DO is copied so the client knows DNSSEC records were asked for
+		// (RFC 3225 §3)
+		setOptDO(opt, dnssecOK(request))
+		reply.Additionals = []*ResourceRecord{opt}
+	}
+	return reply
+}
+
+// udpResponseWriter replies to a query received on a UDP socket. Replies
+// larger than maxSize are truncated with TC set so the client retries over
+// TCP
+type udpResponseWriter struct {
+	conn    *net.UDPConn
+	remote  *net.UDPAddr
+	maxSize int
+}
+
+func (w *udpResponseWriter) WriteMsg(m *Message) error {
+	return writeUDP(w.conn, w.remote, m, w.maxSize)
+}
+
+func (w *udpResponseWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+func (w *udpResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *udpResponseWriter) Network() string {
+	return "udp"
+}
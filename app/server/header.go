@@ -11,9 +11,15 @@ type Header struct {
 	ARCount uint16
 }
 
-func ParseHeader(buf []byte) *Header {
+// ParseHeader parses the fixed 12 byte DNS header at the start of buf
+// Returns the parsed Header and the offset just after it
+func ParseHeader(buf []byte) (*Header, int, error) {
+	if err := need(buf, 0, 12, "header"); err != nil {
+		return nil, 0, err
+	}
 	id := binary.BigEndian.Uint16(buf[:2])
-	flag := NewFlag(buf[2:4])
+	// Copy the flag bytes so the header doesn't alias the read buffer
+	flag := NewFlag([]byte{buf[2], buf[3]})
 	qdcount := binary.BigEndian.Uint16(buf[4:6])
 	ancount := binary.BigEndian.Uint16(buf[6:8])
 	nscount := binary.BigEndian.Uint16(buf[8:10])
@@ -25,7 +31,7 @@ func ParseHeader(buf []byte) *Header {
 		ANCount: ancount,
 		NSCount: nscount,
 		ARCount: arcount,
-	}
+	}, 12, nil
 }
 func (h Header) Marshal() []byte {
 	buf := make([]byte, 12)
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// idSpaceSize is the number of distinct transaction IDs
+const idSpaceSize = 0x10000
+
+// errIDsExhausted fails a query when every ID of its socket is in flight
+var errIDsExhausted = errors.New("dns: every transaction ID on the connection is in flight")
+
+// idSpace allocates the transaction IDs of the queries in flight on a single
+// socket, so no two of them share one and every reply maps back to exactly
+// one query. IDs stay allocated until their query's exchange is over, even if
+// the reply already came, so a late duplicate cannot be taken for the reply
+// to a newer query
+type idSpace struct {
+	used     [idSpaceSize / 64]uint64
+	inFlight int
+}
+
+// alloc allocates preferred if it is free. Otherwise it falls back to a free
+// ID found by scanning from a random starting point, wrapping around past
+// 0xFFFF, so the replacement is as unpredictable as a fresh random ID.
+// collided reports the fallback; ok is false if every ID is in flight
+func (s *idSpace) alloc(preferred uint16) (id uint16, collided, ok bool) {
+	if !s.isUsed(preferred) {
+		s.set(preferred)
+		return preferred, false, true
+	}
+	if s.inFlight == idSpaceSize {
+		return 0, true, false
+	}
+
+	start := randomID()
+	for i := range len(s.used) + 1 {
+		// The first word is scanned from start; after wrapping around, its
+		// lower bits are scanned last
+		word := (int(start)/64 + i) % len(s.used)
+		free := ^s.used[word]
+		switch i {
+		case 0:
+			free &= ^uint64(0) << (start % 64)
+		case len(s.used):
+			free &= 1<<(start%64) - 1
+		}
+		if free != 0 {
+			id = uint16(word*64 + bits.TrailingZeros64(free))
+			s.set(id)
+			return id, true, true
+		}
+	}
+	return 0, true, false
+}
+
+// free releases id for later queries
+func (s *idSpace) free(id uint16) {
+	if s.isUsed(id) {
+		s.used[id/64] &^= 1 << (id % 64)
+		s.inFlight--
+	}
+}
+
+func (s *idSpace) isUsed(id uint16) bool {
+	return s.used[id/64]&(1<<(id%64)) != 0
+}
+
+func (s *idSpace) set(id uint16) {
+	s.used[id/64] |= 1 << (id % 64)
+	s.inFlight++
+}
@@ -0,0 +1,63 @@
+package server
+
+import "testing"
+
+// fullIDSpace returns an idSpace with every ID in flight except those in free
+func fullIDSpace(free ...uint16) *idSpace {
+	s := &idSpace{}
+	for i := range s.used {
+		s.used[i] = ^uint64(0)
+	}
+	s.inFlight = idSpaceSize
+	for _, id := range free {
+		s.free(id)
+	}
+	return s
+}
+
+func TestIDSpaceAlloc(t *testing.T) {
+	tests := []struct {
+		name         string
+		space        *idSpace
+		preferred    uint16
+		want         uint16
+		wantCollided bool
+		wantOK       bool
+	}{
+		{"preferred free", &idSpace{}, 0x1234, 0x1234, false, true},
+		{"preferred in use", fullIDSpace(0x0042), 0x1234, 0x0042, true, true},
+		{"last ID free", fullIDSpace(0xFFFF), 0, 0xFFFF, true, true},
+		{"first ID free", fullIDSpace(0), 0xFFFF, 0, true, true},
+		{"every ID in flight", fullIDSpace(), 0x1234, 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The fallback scan starts at a random ID, so it is repeated to
+			// cover starting before, after and on the free ID
+			for range 100 {
+				space := *tt.space
+				id, collided, ok := space.alloc(tt.preferred)
+				if id != tt.want || collided != tt.wantCollided || ok != tt.wantOK {
+					t.Fatalf("alloc(%#04x) = %#04x, %t, %t, want %#04x, %t, %t",
+						tt.preferred, id, collided, ok, tt.want, tt.wantCollided, tt.wantOK)
+				}
+				if ok && !space.isUsed(id) {
+					t.Fatalf("%#04x allocated but not marked in use", id)
+				}
+			}
+		})
+	}
+}
+
+func TestIDSpaceFree(t *testing.T) {
+	var s idSpace
+	id, _, _ := s.alloc(7)
+	s.free(id)
+	s.free(id)
+	if s.inFlight != 0 {
+		t.Errorf("inFlight %d after freeing twice, want 0", s.inFlight)
+	}
+	if got, collided, _ := s.alloc(7); got != 7 || collided {
+		t.Errorf("alloc(7) after free = %d, collided %t", got, collided)
+	}
+}
@@ -0,0 +1,135 @@
+//go:build integration
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Interop checks of the codec against production DNS servers. They need
+// network access, so they only run with `go test -tags integration`. The
+// servers queried can be replaced with DNS_INTEROP_SERVERS, a comma-separated
+// list of addresses
+
+// interopServers are public resolvers and an authoritative server for
+// interopName (a.iana-servers.net)
+var interopServers = []string{"1.1.1.1:53", "8.8.8.8:53", "199.43.135.53:53"}
+
+// interopName is queried on every server under test. Resolvers and its
+// authoritative servers both answer it
+const interopName = "example.com"
+
+// interopLargeName has a TXT RRset larger than 512 bytes, so plain UDP
+// replies for it must come back truncated
+const interopLargeName = "google.com"
+
+// interopTimeout bounds the checks against a single server
+const interopTimeout = 10 * time.Second
+
+func TestInterop(t *testing.T) {
+	servers := interopServers
+	if env := os.Getenv("DNS_INTEROP_SERVERS"); env != "" {
+		servers = strings.Split(env, ",")
+	}
+	for _, addr := range servers {
+		addr = strings.TrimSpace(addr)
+		t.Run(addr, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), interopTimeout)
+			defer cancel()
+			for _, err := range checkInterop(ctx, addr) {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// checkInterop exchanges queries with the server at addr over UDP with and
+// without EDNS and over TCP, and checks that every reply parses, round-trips
+// through the encoder and respects the UDP size limits and TC retry rules.
+// Returns every failure found
+func checkInterop(ctx context.Context, addr string) []error {
+	var errs []error
+
+	for _, c := range []struct {
+		network string
+		edns    bool
+	}{
+		{"udp", true},
+		{"udp", false},
+		{"tcp", false},
+	} {
+		query := NewQuery(randomID(), interopName, A, c.edns)
+		reply, size, err := interopExchange(ctx, c.network, addr, query)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s query (EDNS %t): %w", c.network, c.edns, err))
+			continue
+		}
+		if c.edns && reply.OPT() == nil {
+			errs = append(errs, fmt.Errorf("%s query: reply to an EDNS query has no OPT record", c.network))
+		}
+		if c.network == "udp" && size > query.UDPSize() {
+			errs = append(errs, fmt.Errorf("udp query (EDNS %t): reply of %d bytes exceeds %d", c.edns, size, query.UDPSize()))
+		}
+	}
+
+	// Without EDNS a large answer must be truncated to fit 512 bytes and then
+	// be retrieved in full over TCP
+	query := NewQuery(randomID(), interopLargeName, TXT, false)
+	truncated, _, err := interopExchange(ctx, "udp", addr, query)
+	if err != nil {
+		return append(errs, fmt.Errorf("large udp query: %w", err))
+	}
+	if !truncated.Header.Flag.GetTC() {
+		return errs
+	}
+	full, _, err := interopExchange(ctx, "tcp", addr, query)
+	if err != nil {
+		return append(errs, fmt.Errorf("tcp retry of truncated query: %w", err))
+	}
+	if full.Header.Flag.GetTC() {
+		errs = append(errs, fmt.Errorf("tcp retry of truncated query: reply has TC set"))
+	}
+	if len(full.Answers) < len(truncated.Answers) {
+		errs = append(errs, fmt.Errorf("tcp retry of truncated query: %d answers, fewer than the %d over udp", len(full.Answers), len(truncated.Answers)))
+	}
+	return errs
+}
+
+// interopExchange sends query and checks the reply is well formed and matches
+// it. Returns the parsed reply and its size on the wire. VerifyCompression is
+// not applied: other servers may point names at names inside earlier RDATA,
+// which it does not track as the server's own encoder never does that
+func interopExchange(ctx context.Context, network, addr string, query *Message) (*Message, int, error) {
+	raw, err := exchange(ctx, network, addr, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	reply, err := ParseMessage(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkRoundTrip(reply); err != nil {
+		return nil, 0, err
+	}
+
+	if !reply.Header.Flag.GetQR() {
+		return nil, 0, fmt.Errorf("reply has QR unset")
+	}
+	if rcode := reply.RCode(); rcode != RCodeNoError {
+		return nil, 0, fmt.Errorf("reply has rcode %s", rcode)
+	}
+	// Truncated replies may omit the question, complete ones must echo it
+	if len(reply.Questions) > 0 || !reply.Header.Flag.GetTC() {
+		if len(reply.Questions) != 1 ||
+			CanonicalName(reply.Questions[0].Name) != CanonicalName(query.Questions[0].Name) ||
+			reply.Questions[0].Type != query.Questions[0].Type {
+			return nil, 0, fmt.Errorf("reply does not echo the question")
+		}
+	}
+	return reply, len(raw), nil
+}
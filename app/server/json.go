@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// JSON encoding of DNS messages following the member names of RFC 8427.
+// Flags are written as 0/1 integers like the examples in the RFC; both
+// integers and booleans are accepted when decoding
+
+// jsonBit is a single header flag bit in JSON form
+type jsonBit uint8
+
+func newJSONBit(set bool) jsonBit {
+	if set {
+		return 1
+	}
+	return 0
+}
+
+func (b *jsonBit) UnmarshalJSON(data []byte) error {
+	switch strings.TrimSpace(string(data)) {
+	case "1", "true":
+		*b = 1
+	case "0", "false", "null":
+		*b = 0
+	default:
+		return fmt.Errorf("dns: invalid flag value %s", data)
+	}
+	return nil
+}
+
+type headerJSON struct {
+	ID      uint16  `json:"ID"`
+	QR      jsonBit `json:"QR"`
+	Opcode  uint8   `json:"Opcode"`
+	AA      jsonBit `json:"AA"`
+	TC      jsonBit `json:"TC"`
+	RD      jsonBit `json:"RD"`
+	RA      jsonBit `json:"RA"`
+	AD      jsonBit `json:"AD"`
+	CD      jsonBit `json:"CD"`
+	RCODE   uint16  `json:"RCODE"`
+	QDCOUNT uint16  `json:"QDCOUNT"`
+	ANCOUNT uint16  `json:"ANCOUNT"`
+	NSCOUNT uint16  `json:"NSCOUNT"`
+	ARCOUNT uint16  `json:"ARCOUNT"`
+}
+
+func newHeaderJSON(h *Header) headerJSON {
+	return headerJSON{
+		ID:      h.ID,
+		QR:      newJSONBit(h.Flag.GetQR()),
+		Opcode:  uint8(h.Flag.GetOPCode()),
+		AA:      newJSONBit(h.Flag.GetAA()),
+		TC:      newJSONBit(h.Flag.GetTC()),
+		RD:      newJSONBit(h.Flag.GetRD()),
+		RA:      newJSONBit(h.Flag.GetRA()),
+		AD:      newJSONBit(h.Flag.GetAD()),
+		CD:      newJSONBit(h.Flag.GetCD()),
+		RCODE:   uint16(h.Flag.GetRCode()),
+		QDCOUNT: h.QDCount,
+		ANCOUNT: h.ANCount,
+		NSCOUNT: h.NSCount,
+		ARCOUNT: h.ARCount,
+	}
+}
+
+func (j headerJSON) header() *Header {
+	flag := NewFlag([]byte{0x00, 0x00})
+	flag.SetQR(j.QR == 1)
+	flag.SetOPCode(OPCode(j.Opcode))
+	flag.SetAA(j.AA == 1)
+	flag.SetTC(j.TC == 1)
+	flag.SetRD(j.RD == 1)
+	flag.SetRA(j.RA == 1)
+	flag.SetAD(j.AD == 1)
+	flag.SetCD(j.CD == 1)
+	flag.SetRCode(RCode(j.RCODE))
+	return &Header{
+		ID:      j.ID,
+		Flag:    flag,
+		QDCount: j.QDCOUNT,
+		ANCount: j.ANCOUNT,
+		NSCount: j.NSCOUNT,
+		ARCount: j.ARCOUNT,
+	}
+}
+
+func (h Header) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newHeaderJSON(&h))
+}
+
+func (h *Header) UnmarshalJSON(data []byte) error {
+	var j headerJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*h = *j.header()
+	return nil
+}
+
+type questionJSON struct {
+	NAME      string       `json:"NAME"`
+	TYPE      QuestionType `json:"TYPE"`
+	TYPEname  string       `json:"TYPEname,omitempty"`
+	CLASS     uint16       `json:"CLASS"`
+	CLASSname string       `json:"CLASSname,omitempty"`
+}
+
+func (q Question) MarshalJSON() ([]byte, error) {
+	return json.Marshal(questionJSON{
+		NAME:      q.Name,
+		TYPE:      q.Type,
+		TYPEname:  q.Type.String(),
+		CLASS:     q.Class,
+		CLASSname: ClassString(q.Class),
+	})
+}
+
+func (q *Question) UnmarshalJSON(data []byte) error {
+	var j questionJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if err := checkDomainName(j.NAME); err != nil {
+		return err
+	}
+	*q = Question{
+		Name:  j.NAME,
+		Type:  j.TYPE,
+		Class: j.CLASS,
+	}
+	return nil
+}
+
+type resourceRecordJSON struct {
+	NAME      string       `json:"NAME"`
+	TYPE      QuestionType `json:"TYPE"`
+	TYPEname  string       `json:"TYPEname,omitempty"`
+	CLASS     uint16       `json:"CLASS"`
+	CLASSname string       `json:"CLASSname,omitempty"`
+	TTL       uint32       `json:"TTL"`
+	RDLENGTH  int          `json:"RDLENGTH"`
+	RDATAHEX  string       `json:"RDATAHEX"`
+}
+
+func (rr ResourceRecord) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(resourceRecordJSON{
+		NAME:      rr.Name,
+		TYPE:      rr.Type,
+		TYPEname:  rr.Type.String(),
+		CLASS:     rr.Class,
+		CLASSname: ClassString(rr.Class),
+		TTL:       rr.TTL,
+		RDLENGTH:  len(rr.Data),
+		RDATAHEX:  strings.ToUpper(hex.EncodeToString(rr.Data)),
+	})
+	if err != nil || !rr.Type.Known() {
+		return data, err
+	}
+
+	// Known types also carry their presentation form as rdata<TYPE>
+	// (e.g. "rdataA": "192.0.2.1"), unless it can only be shown generically
+	rdata := rr.DataString()
+	if rdata == rr.GenericData() {
+		return data, nil
+	}
+	member, err := json.Marshal(rdata)
+	if err != nil {
+		return nil, err
+	}
+	extra := fmt.Sprintf(`,"rdata%s":%s}`, rr.Type, member)
+	return append(data[:len(data)-1], extra...), nil
+}
+
+func (rr *ResourceRecord) UnmarshalJSON(data []byte) error {
+	var j resourceRecordJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if err := checkDomainName(j.NAME); err != nil {
+		return err
+	}
+	rdata, err := hex.DecodeString(j.RDATAHEX)
+	if err != nil {
+		return fmt.Errorf("dns: invalid RDATAHEX: %w", err)
+	}
+	*rr = ResourceRecord{
+		Name:  j.NAME,
+		Type:  j.TYPE,
+		Class: j.CLASS,
+		TTL:   j.TTL,
+		Data:  rdata,
+	}
+	return nil
+}
+
+type messageJSON struct {
+	headerJSON
+	QuestionRRs   []*Question       `json:"questionRRs,omitempty"`
+	AnswerRRs     []*ResourceRecord `json:"answerRRs,omitempty"`
+	AuthorityRRs  []*ResourceRecord `json:"authorityRRs,omitempty"`
+	AdditionalRRs []*ResourceRecord `json:"additionalRRs,omitempty"`
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	j := messageJSON{
+		headerJSON:    newHeaderJSON(m.Header),
+		QuestionRRs:   m.Questions,
+		AnswerRRs:     m.Answers,
+		AuthorityRRs:  m.Authorities,
+		AdditionalRRs: m.Additionals,
+	}
+	j.QDCOUNT = uint16(len(m.Questions))
+	j.ANCOUNT = uint16(len(m.Answers))
+	j.NSCOUNT = uint16(len(m.Authorities))
+	j.ARCOUNT = uint16(len(m.Additionals))
+	return json.Marshal(j)
+}
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var j messageJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*m = Message{
+		Header:      j.header(),
+		Questions:   j.QuestionRRs,
+		Answers:     j.AnswerRRs,
+		Authorities: j.AuthorityRRs,
+		Additionals: j.AdditionalRRs,
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalJSONRejectsInvalidNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		into    any
+		json    string
+		wantErr bool
+	}{
+		{"question", &Question{}, `{"NAME":"example.com","TYPE":1,"CLASS":1}`, false},
+		{"question with 64-byte label", &Question{}, `{"NAME":"` + strings.Repeat("a", 64) + `.com","TYPE":1,"CLASS":1}`, true},
+		{"question longer than 255 bytes", &Question{}, `{"NAME":"` + longName(4) + `","TYPE":1,"CLASS":1}`, true},
+		{"record", &ResourceRecord{}, `{"NAME":"example.com","TYPE":1,"CLASS":1,"TTL":60,"RDATAHEX":"c0000201"}`, false},
+		{"record with 64-byte label", &ResourceRecord{}, `{"NAME":"` + strings.Repeat("a", 64) + `.com","TYPE":1,"CLASS":1,"TTL":60,"RDATAHEX":"c0000201"}`, true},
+		{"record longer than 255 bytes", &ResourceRecord{}, `{"NAME":"` + longName(4) + `","TYPE":1,"CLASS":1,"TTL":60,"RDATAHEX":"c0000201"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := json.Unmarshal([]byte(tt.json), tt.into)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// listener is a socket the server takes queries from. Every listen address
+// is served by its UDP sockets and, unless disabled with WithTCP, a TCP
+// listener on the same port, so clients pick the transport per query
+type listener interface {
+	// serve reads queries until the server is closing, dispatching each to
+	// the worker pool queue. Returns nil once the server is closing
+	serve(queue chan packetJob) error
+	// stopReading unblocks serve while leaving replies still writable
+	stopReading()
+	// Close closes the socket
+	Close() error
+}
+
+// listen opens the listeners for a single address: its UDP sockets, then a
+// TCP listener on the port the UDP sockets got, which matters when the
+// address asks for any free port
+func (s *DNSServer) listen(addr *net.UDPAddr) ([]listener, error) {
+	conns, err := s.listenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	listeners := make([]listener, 0, len(conns)+1)
+	for _, conn := range conns {
+		listeners = append(listeners, &udpListener{s: s, conn: conn})
+	}
+
+	if s.tcp {
+		l, err := net.Listen("tcp", conns[0].LocalAddr().String())
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, &tcpListener{s: s, l: l})
+	}
+	return listeners, nil
+}
+
+// closeListeners closes every listener of listeners
+func closeListeners(listeners []listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// udpListener serves a single UDP socket
+type udpListener struct {
+	s    *DNSServer
+	conn *net.UDPConn
+}
+
+// serve runs the read loop of the socket, dispatching each packet to the
+// worker pool queue or, without one, to its own goroutine
+func (l *udpListener) serve(queue chan packetJob) error {
+	buf := make([]byte, maxUDPReadSize)
+
+	for {
+		size, source, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if l.s.closing.Load() {
+				return nil
+			}
+			return err
+		}
+
+		// The read buffer is reused for the next packet, so each handler gets
+		// its own copy
+		packet := make([]byte, size)
+		copy(packet, buf[:size])
+
+		l.s.dispatch(queue, &udpResponseWriter{conn: l.conn, remote: source, maxSize: maxUDPSize}, packet, nil)
+	}
+}
+
+// stopReading unblocks the read loop; the socket stays open for the replies
+// of queries still in flight
+func (l *udpListener) stopReading() {
+	l.conn.SetReadDeadline(time.Now())
+}
+
+func (l *udpListener) Close() error {
+	return l.conn.Close()
+}
+
+// tcpListener accepts TCP connections, see tcp.go
+type tcpListener struct {
+	s *DNSServer
+	l net.Listener
+}
+
+// serve accepts connections until the server is closing, serving each one in
+// its own goroutine
+func (l *tcpListener) serve(queue chan packetJob) error {
+	for {
+		conn, err := l.l.Accept()
+		if err != nil {
+			if l.s.closing.Load() {
+				return nil
+			}
+			return err
+		}
+		if !l.s.trackTCPConn(conn) {
+			conn.Close()
+			continue
+		}
+
+		l.s.tcpConnsWG.Add(1)
+		go l.s.serveTCPConn(conn, queue)
+	}
+}
+
+// stopReading closes the listener. Open connections are stopped separately,
+// as each may still have replies to write
+func (l *tcpListener) stopReading() {
+	l.l.Close()
+}
+
+func (l *tcpListener) Close() error {
+	return l.l.Close()
+}
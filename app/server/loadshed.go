@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"runtime/metrics"
+	"time"
+)
+
+// heapMetric is the runtime metric sampled to detect memory pressure: bytes
+// occupied by live and not yet swept heap objects
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// memorySampleInterval is how often heap usage is checked
+const memorySampleInterval = time.Second
+
+// WithMemoryLimit enables load shedding once heap usage exceeds limit bytes.
+// While under pressure the server sheds low-priority queries according to
+// WithShedFraction and other subsystems may shrink themselves
+func WithMemoryLimit(limit uint64) Option {
+	return func(s *DNSServer) {
+		s.memoryLimit = limit
+	}
+}
+
+// WithShedFraction sets the fraction (0 to 1) of low-priority queries (ANY and
+// unknown types) dropped while under memory pressure. Defaults to 0, meaning
+// pressure is only reported and never causes queries to be dropped
+func WithShedFraction(fraction float64) Option {
+	return func(s *DNSServer) {
+		s.shedFraction = fraction
+	}
+}
+
+// UnderMemoryPressure reports whether heap usage is currently above the
+// configured memory limit
+func (s *DNSServer) UnderMemoryPressure() bool {
+	return s.pressure.Load()
+}
+
+// Shed returns how many queries were dropped because of memory pressure
+func (s *DNSServer) Shed() uint64 {
+	return s.shed.Load()
+}
+
+// monitorMemory samples heap usage until stop is closed, flipping the memory
+// pressure state and logging each transition. The cache is halved whenever
+// pressure starts
+func (s *DNSServer) monitorMemory(stop <-chan struct{}) {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	ticker := time.NewTicker(memorySampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		metrics.Read(sample)
+		if sample[0].Value.Kind() != metrics.KindUint64 {
+			return
+		}
+		heap := sample[0].Value.Uint64()
+
+		pressure := heap > s.memoryLimit
+		if s.pressure.Swap(pressure) != pressure {
+			if pressure {
+				fmt.Printf("Memory pressure: heap %d bytes over limit %d, shedding %.0f%% of low-priority queries\n",
+					heap, s.memoryLimit, s.shedFraction*100)
+				if s.cache != nil {
+					s.cache.shrink(time.Now())
+				}
+			} else {
+				fmt.Printf("Memory pressure relieved: heap %d bytes\n", heap)
+			}
+		}
+	}
+}
+
+// shouldShed decides whether a query is dropped because of memory pressure.
+// Only low-priority queries are ever shed
+func (s *DNSServer) shouldShed(request *Message) bool {
+	if !s.pressure.Load() || s.shedFraction <= 0 || !lowPriority(request) {
+		return false
+	}
+	return rand.Float64() < s.shedFraction
+}
+
+// lowPriority reports whether a query only asks for ANY or unknown types,
+// which are the first to go under pressure
+func lowPriority(request *Message) bool {
+	if len(request.Questions) == 0 {
+		return false
+	}
+	for _, q := range request.Questions {
+		if q.Type != ANY && q.Type.Known() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,183 @@
+package server
+
+import "fmt"
+
+// Message represents a complete DNS message: a header followed by the
+// question, answer, authority and additional sections
+type Message struct {
+	Header      *Header
+	Questions   []*Question
+	Answers     []*ResourceRecord
+	Authorities []*ResourceRecord
+	Additionals []*ResourceRecord
+
+	// extendedError is the last code given to SetExtendedError, kept even
+	// when the client cannot receive it so statistics still see it
+	extendedError uint16
+}
+
+// ParseMessage parses a DNS message from wire format, decoding as many
+// questions and records as the header counts announce. If the header could be
+// parsed but a later section could not, the partially filled Message is
+// returned alongside the error so callers can still reply with its ID
+func ParseMessage(buf []byte) (*Message, error) {
+	header, offset, err := ParseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{
+		Header: header,
+	}
+
+	for i := 0; i < int(header.QDCount); i++ {
+		var q *Question
+		q, offset, err = ParseQuestion(buf, offset)
+		if err != nil {
+			return m, fmt.Errorf("question %d: %w", i, err)
+		}
+		m.Questions = append(m.Questions, q)
+	}
+
+	if m.Answers, offset, err = parseRecords(buf, offset, int(header.ANCount)); err != nil {
+		return m, fmt.Errorf("answer section: %w", err)
+	}
+	if m.Authorities, offset, err = parseRecords(buf, offset, int(header.NSCount)); err != nil {
+		return m, fmt.Errorf("authority section: %w", err)
+	}
+	if m.Additionals, _, err = parseRecords(buf, offset, int(header.ARCount)); err != nil {
+		return m, fmt.Errorf("additional section: %w", err)
+	}
+
+	return m, nil
+}
+
+// parseRecords parses count consecutive resource records starting at offset
+func parseRecords(buf []byte, offset int, count int) ([]*ResourceRecord, int, error) {
+	var records []*ResourceRecord
+	for i := 0; i < count; i++ {
+		rr, newOffset, err := ParseResourceRecord(buf, offset)
+		if err != nil {
+			return records, 0, fmt.Errorf("record %d: %w", i, err)
+		}
+		records = append(records, rr)
+		offset = newOffset
+	}
+	return records, offset, nil
+}
+
+// Marshal serializes the Message into DNS wire format. The section counts in
+// the header are taken from the sections themselves so they always match
+// what is written. Repeated names are compressed. Fails if a name is too long
+// for the wire
+func (m *Message) Marshal() ([]byte, error) {
+	header := *m.Header
+	header.QDCount = uint16(len(m.Questions))
+	header.ANCount = uint16(len(m.Answers))
+	header.NSCount = uint16(len(m.Authorities))
+	header.ARCount = uint16(len(m.Additionals))
+
+	comp := make(compressionMap)
+	buf := header.Marshal()
+	var err error
+	for _, q := range m.Questions {
+		if buf, err = q.appendTo(buf, comp); err != nil {
+			return nil, err
+		}
+	}
+	for _, section := range [][]*ResourceRecord{m.Answers, m.Authorities, m.Additionals} {
+		for _, rr := range section {
+			if buf, err = rr.appendTo(buf, comp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+// MarshalTruncated serializes the Message like Marshal, but if the result
+// would exceed maxSize bytes it is cut at the last record boundary that fits
+// and the header counts are adjusted to match. TC is set when answer or
+// authority records had to be dropped; losing only additional records does
+// not set it (RFC 2181 §9). An OPT record is always kept, written last, so the
+// client still learns the server's EDNS parameters (RFC 6891 §7). Returns the
+// bytes and whether TC was set, or an error if a name is too long for the wire
+func (m *Message) MarshalTruncated(maxSize int) ([]byte, bool, error) {
+	var additionals, opts []*ResourceRecord
+	for _, rr := range m.Additionals {
+		if rr.Type == OPT {
+			opts = append(opts, rr)
+		} else {
+			additionals = append(additionals, rr)
+		}
+	}
+
+	header := *m.Header
+	header.QDCount = uint16(len(m.Questions))
+	header.ANCount = uint16(len(m.Answers))
+	header.NSCount = uint16(len(m.Authorities))
+	header.ARCount = uint16(len(m.Additionals))
+
+	comp := make(compressionMap)
+	buf := header.Marshal()
+	var err error
+	for _, q := range m.Questions {
+		if buf, err = q.appendTo(buf, comp); err != nil {
+			return nil, false, err
+		}
+	}
+	questionsEnd := len(buf)
+
+	// Offset just after each record. Compression pointers only ever point
+	// backwards, so any prefix ending on a record boundary is a valid message
+	var ends []int
+	for _, section := range [][]*ResourceRecord{m.Answers, m.Authorities, additionals} {
+		for _, rr := range section {
+			if buf, err = rr.appendTo(buf, comp); err != nil {
+				return nil, false, err
+			}
+			ends = append(ends, len(buf))
+		}
+	}
+
+	// OPT owner names are the root, so they never need the compression map
+	var optBytes []byte
+	for _, rr := range opts {
+		if optBytes, err = rr.appendTo(optBytes, nil); err != nil {
+			return nil, false, err
+		}
+	}
+	if len(buf)+len(optBytes) <= maxSize {
+		return append(buf, optBytes...), false, nil
+	}
+
+	// Keep as many leading records as fit alongside the OPT record, or drop
+	// the questions too if even they are too large
+	limit := maxSize - len(optBytes)
+	kept := 0
+	for kept < len(ends) && ends[kept] <= limit {
+		kept++
+	}
+	end := questionsEnd
+	if kept > 0 {
+		end = ends[kept-1]
+	}
+	if end > limit {
+		end = 12
+		header.QDCount = 0
+	}
+
+	header.ANCount = uint16(min(kept, len(m.Answers)))
+	kept -= int(header.ANCount)
+	header.NSCount = uint16(min(kept, len(m.Authorities)))
+	kept -= int(header.NSCount)
+	header.ARCount = uint16(kept + len(opts))
+
+	truncated := int(header.ANCount) < len(m.Answers) || int(header.NSCount) < len(m.Authorities)
+	if truncated {
+		header.Flag = NewFlag([]byte{header.Flag.flagByte[0], header.Flag.flagByte[1]})
+		header.Flag.SetTC(true)
+	}
+	copy(buf, header.Marshal())
+
+	return append(buf[:end], optBytes...), truncated, nil
+}
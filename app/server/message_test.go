@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+// mxReply returns the wire format of a reply to example.com A carrying an MX
+// answer, and the offset of the answer's RDLENGTH
+func mxReply(t *testing.T) ([]byte, int) {
+	query := NewQuery(0x1234, "example.com", A, false)
+	reply := NewReply(query)
+	reply.Answers = []*ResourceRecord{
+		{Name: "example.com", Type: MX, Class: 1, TTL: 300, Data: rdata([]byte{0, 10}, wireName("mail.example.com"))},
+	}
+	buf, err := reply.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf, len(buf) - len(reply.Answers[0].Data) - 2
+}
+
+func TestParseMessageBounds(t *testing.T) {
+	full, rdLength := mxReply(t)
+
+	// withRDLength returns the reply with its RDLENGTH field set to n
+	withRDLength := func(n uint16) []byte {
+		buf := append([]byte(nil), full...)
+		binary.BigEndian.PutUint16(buf[rdLength:], n)
+		return buf
+	}
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		wantErr bool
+	}{
+		{"complete", full, false},
+		{"header cut", full[:5], true},
+		{"question cut", full[:20], true},
+		{"record fixed fields cut", full[:rdLength], true},
+		{"rdata cut", full[:len(full)-3], true},
+		{"RDLENGTH past the end", withRDLength(uint16(len(full)-rdLength)), true},
+		{"RDLENGTH ending inside a name", withRDLength(4), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseMessage(tt.packet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrTruncated) {
+				t.Errorf("error %v does not wrap ErrTruncated", err)
+			}
+		})
+	}
+}
+
+func TestHandlePacketFormErr(t *testing.T) {
+	full, _ := mxReply(t)
+	tests := []struct {
+		name    string
+		packet  []byte
+		replies int
+	}{
+		{"no header is dropped", full[:5], 0},
+		{"bad question gets FORMERR", full[:20], 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &testWriter{}
+			NewDnsServer(nil).handlePacket(w, tt.packet)
+			if len(w.replies) != tt.replies {
+				t.Fatalf("%d replies, want %d", len(w.replies), tt.replies)
+			}
+			if tt.replies > 0 {
+				reply := w.replies[0]
+				if reply.RCode() != RCodeFormErr || reply.Header.ID != 0x1234 {
+					t.Errorf("reply rcode %s ID %#x, want FORMERR to ID 0x1234", reply.RCode(), reply.Header.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalTruncated(t *testing.T) {
+	query := NewQuery(1, "example.com", A, true)
+	reply := NewReply(query)
+	for i := range 10 {
+		reply.Answers = append(reply.Answers, NewARecord("example.com", net.IPv4(192, 0, 2, byte(i)), 300))
+	}
+	for i := range 3 {
+		reply.Additionals = append(reply.Additionals, NewARecord("ns.example.com", net.IPv4(198, 51, 100, byte(i)), 300))
+	}
+	opt, err := reply.OPT().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each answer takes 16 bytes once compressed, the header and question 29
+	tests := []struct {
+		name        string
+		maxSize     int
+		questions   int
+		answers     int
+		additionals int
+		tc          bool
+	}{
+		{"fits", 4096, 1, 10, 3, false},
+		{"additionals dropped", 29 + 10*16 + len(opt), 1, 10, 0, false},
+		{"answers dropped", 29 + 3*16 + len(opt) + 15, 1, 3, 0, true},
+		{"question dropped", 12 + len(opt) + 16, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, tc, err := reply.MarshalTruncated(tt.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf) > tt.maxSize {
+				t.Errorf("%d bytes, want at most %d", len(buf), tt.maxSize)
+			}
+			m, err := ParseMessage(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc != tt.tc || m.Header.Flag.GetTC() != tt.tc {
+				t.Errorf("TC returned %t, in header %t, want %t", tc, m.Header.Flag.GetTC(), tt.tc)
+			}
+			if len(m.Questions) != tt.questions || len(m.Answers) != tt.answers {
+				t.Errorf("%d questions and %d answers, want %d and %d", len(m.Questions), len(m.Answers), tt.questions, tt.answers)
+			}
+			// The OPT record is always kept, after the other additionals
+			if n := len(m.Additionals); n != tt.additionals+1 || m.Additionals[n-1].Type != OPT {
+				t.Errorf("additionals %v, want %d records then OPT", recordTypes(m.Additionals), tt.additionals)
+			}
+		})
+	}
+}
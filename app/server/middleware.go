@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Middleware wraps a Handler with extra behaviour such as logging, metrics,
+// caching or access control, without touching the core server loop
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with the given middleware. The first middleware is the
+// outermost one and sees each query first
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// WithMiddleware wraps the server's handler with the given middleware, see
+// Chain for ordering
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(s *DNSServer) {
+		s.middleware = append(s.middleware, middleware...)
+	}
+}
+
+// Use appends middleware to the server's chain. It must be called before
+// Listen
+func (s *DNSServer) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// recordingWriter remembers the reply written through it so middleware can
+// inspect it after the next handler returns
+type recordingWriter struct {
+	ResponseWriter
+	reply *Message
+}
+
+func (w *recordingWriter) WriteMsg(m *Message) error {
+	w.reply = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Logging logs every query and the reply sent for it in dig format
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			fmt.Printf("Received query from %s over %s:\n%s", w.RemoteAddr(), w.Network(), r)
+
+			rw := &recordingWriter{ResponseWriter: w}
+			next.ServeDNS(rw, r)
+
+			if rw.reply == nil {
+				fmt.Printf("No reply sent to %s\n", w.RemoteAddr())
+				return
+			}
+			fmt.Printf("Replied to %s:\n%s", w.RemoteAddr(), rw.reply)
+		})
+	}
+}
+
+// Metrics records the rcode and handling latency of every reply in stats, and
+// who it went to and for which name
+func Metrics(stats *QueryStats) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			start := time.Now()
+			rw := &recordingWriter{ResponseWriter: w}
+			next.ServeDNS(rw, r)
+
+			if rw.reply == nil {
+				return
+			}
+			rcode := rw.reply.RCode()
+			stats.RecordResponse(rcode, time.Since(start))
+
+			client := w.RemoteAddr().String()
+			if addr, ok := clientAddr(w.RemoteAddr()); ok {
+				client = addr.String()
+			}
+			name := ""
+			if len(r.Questions) > 0 {
+				name = CanonicalName(r.Questions[0].Name) + "."
+			}
+			stats.RecordTalker(client, name, rcode, blockedReply(rw.reply))
+		})
+	}
+}
+
+// Recovery turns a panic in the next handler into a SERVFAIL reply (unless a
+// reply was already sent), counts it in Panics and logs it with its stack, so
+// a single bad query cannot take down the server
+func (s *DNSServer) Recovery() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			rw := &recordingWriter{ResponseWriter: w}
+			defer func() {
+				if p := recover(); p != nil {
+					s.panics.Add(1)
+					fmt.Printf("Handler panic for query %d from %s: %v\n%s", r.Header.ID, w.RemoteAddr(), p, truncatedStack())
+					if rw.reply == nil {
+						if err := w.WriteMsg(newErrorReply(r, RCodeServFail)); err != nil {
+							fmt.Printf("Failed to reply to %s: %v\n", w.RemoteAddr(), err)
+						}
+					}
+				}
+			}()
+			next.ServeDNS(rw, r)
+		})
+	}
+}
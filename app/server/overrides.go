@@ -0,0 +1,100 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Override is a static answer returned for a name and type regardless of any
+// other data the server has, until it expires. Useful for emergency traffic
+// steering
+type Override struct {
+	Name    string
+	Type    QuestionType
+	Answers []*ResourceRecord
+	Expires time.Time // Zero means the override never expires
+}
+
+type overrideKey struct {
+	name  string
+	qtype QuestionType
+}
+
+// Overrides is a concurrency safe set of static answer overrides keyed by
+// canonical name and type
+type Overrides struct {
+	mu      sync.RWMutex
+	entries map[overrideKey]Override
+}
+
+func NewOverrides() *Overrides {
+	return &Overrides{
+		entries: make(map[overrideKey]Override),
+	}
+}
+
+// Set adds or replaces the override for ov.Name and ov.Type
+func (o *Overrides) Set(ov Override) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries[overrideKey{CanonicalName(ov.Name), ov.Type}] = ov
+}
+
+// Delete removes the override for name and qtype, if any
+func (o *Overrides) Delete(name string, qtype QuestionType) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.entries, overrideKey{CanonicalName(name), qtype})
+}
+
+// Lookup returns the answers overriding name and qtype at the given time.
+// Expired overrides are removed as they are found
+func (o *Overrides) Lookup(name string, qtype QuestionType, now time.Time) ([]*ResourceRecord, bool) {
+	key := overrideKey{CanonicalName(name), qtype}
+
+	o.mu.RLock()
+	ov, ok := o.entries[key]
+	o.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	if !ov.Expires.IsZero() && !now.Before(ov.Expires) {
+		o.mu.Lock()
+		// Only remove it if it wasn't replaced in the meantime
+		if current, ok := o.entries[key]; ok && current.Expires.Equal(ov.Expires) {
+			delete(o.entries, key)
+		}
+		o.mu.Unlock()
+		return nil, false
+	}
+	return ov.Answers, true
+}
+
+// exists reports whether an override that has not expired at now is set for
+// name or a name below it, so name exists in the DNS tree
+func (o *Overrides) exists(name string, now time.Time) bool {
+	name = CanonicalName(name)
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for key, ov := range o.entries {
+		if isSubdomain(key.name, name) && (ov.Expires.IsZero() || now.Before(ov.Expires)) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithOverride installs a static answer override when the server is created.
+// Overrides can also be changed at runtime through DNSServer.Overrides
+func WithOverride(ov Override) Option {
+	return func(s *DNSServer) {
+		s.overrides.Set(ov)
+	}
+}
+
+// Overrides returns the server's static answer overrides
+func (s *DNSServer) Overrides() *Overrides {
+	return s.overrides
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// maxStackBytes bounds how much of a goroutine stack is logged after a panic,
+// enough to locate the bug without flooding the logs during an attack
+const maxStackBytes = 2048
+
+// truncatedStack returns the current goroutine's stack, cut to maxStackBytes
+func truncatedStack() []byte {
+	stack := debug.Stack()
+	if len(stack) > maxStackBytes {
+		stack = append(stack[:maxStackBytes:maxStackBytes], "\n\t...\n"...)
+	}
+	return stack
+}
+
+// recoverPacket is deferred around the handling of each packet so a panic
+// while processing one query is counted and logged instead of crashing the
+// whole listener
+func (s *DNSServer) recoverPacket(source fmt.Stringer) {
+	if p := recover(); p != nil {
+		s.panics.Add(1)
+		fmt.Printf("Recovered panic handling packet from %s: %v\n%s", source, p, truncatedStack())
+	}
+}
+
+// background runs task in its own goroutine on behalf of the server, such as
+// a cache refresh. A panic in it is counted and logged like one handling a
+// packet. It is only started from handlers, so the task joins the packets in
+// flight and Listen does not return before it is done
+func (s *DNSServer) background(name string, task func()) {
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		defer func() {
+			if p := recover(); p != nil {
+				s.panics.Add(1)
+				fmt.Printf("Recovered panic in %s: %v\n%s", name, p, truncatedStack())
+			}
+		}()
+		task()
+	}()
+}
+
+// Panics returns how many queries and background tasks panicked while being
+// handled
+func (s *DNSServer) Panics() uint64 {
+	return s.panics.Load()
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Minimal reader for classic libpcap capture files, just enough to pull UDP
+// datagrams out of captured DNS traffic for replay
+
+// Link types of the capture formats understood by readPcap
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+// maxPcapRecord is the longest record readPcap loads, the size of the largest
+// IP packet. Longer records, such as TCP segments merged by offloading, carry
+// no DNS datagram and are skipped without being read into memory
+const maxPcapRecord = 65535
+
+// udpDatagram is a UDP payload extracted from a capture with its endpoints
+type udpDatagram struct {
+	src     *net.UDPAddr
+	dst     *net.UDPAddr
+	payload []byte
+}
+
+// readPcap reads every UDP datagram from a pcap capture. Packets that are not
+// UDP over IPv4/IPv6, or are IP fragments, are skipped
+func readPcap(r io.Reader) ([]udpDatagram, error) {
+	var global [24]byte
+	if _, err := io.ReadFull(r, global[:]); err != nil {
+		return nil, fmt.Errorf("pcap: reading file header: %w", err)
+	}
+
+	var order binary.ByteOrder
+	switch magic := binary.LittleEndian.Uint32(global[:4]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("pcap: unknown magic number %#x", magic)
+	}
+	snapLen := order.Uint32(global[16:20])
+	linkType := order.Uint32(global[20:24])
+
+	var datagrams []udpDatagram
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(r, record[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return datagrams, nil
+			}
+			return nil, fmt.Errorf("pcap: reading record header: %w", err)
+		}
+		// A record is never captured longer than the snapshot length, so a
+		// longer one means the file is corrupt
+		length := order.Uint32(record[8:12])
+		if length > snapLen {
+			return nil, fmt.Errorf("pcap: record of %d bytes exceeds the snapshot length of %d", length, snapLen)
+		}
+		if length > maxPcapRecord {
+			if _, err := io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return nil, fmt.Errorf("pcap: reading record: %w", err)
+			}
+			continue
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, fmt.Errorf("pcap: reading record: %w", err)
+		}
+
+		if d, ok := decodeFrame(linkType, frame); ok {
+			datagrams = append(datagrams, d)
+		}
+	}
+}
+
+// decodeFrame strips the link layer header and decodes the IP packet inside
+func decodeFrame(linkType uint32, frame []byte) (udpDatagram, bool) {
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return udpDatagram{}, false
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:14])
+		frame = frame[14:]
+		// Skip a single 802.1Q VLAN tag
+		if etherType == 0x8100 && len(frame) >= 4 {
+			etherType = binary.BigEndian.Uint16(frame[2:4])
+			frame = frame[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return udpDatagram{}, false
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return udpDatagram{}, false
+		}
+		frame = frame[16:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return udpDatagram{}, false
+	}
+	return decodeIP(frame)
+}
+
+// decodeIP extracts the UDP datagram carried by an IPv4 or IPv6 packet
+func decodeIP(packet []byte) (udpDatagram, bool) {
+	if len(packet) == 0 {
+		return udpDatagram{}, false
+	}
+
+	var src, dst net.IP
+	var payload []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return udpDatagram{}, false
+		}
+		headerLength := int(packet[0]&0x0F) * 4
+		fragment := binary.BigEndian.Uint16(packet[6:8])
+		// Protocol must be UDP and the packet must not be a fragment
+		if packet[9] != 17 || fragment&0x3FFF != 0 || len(packet) < headerLength {
+			return udpDatagram{}, false
+		}
+		src, dst = net.IP(packet[12:16]), net.IP(packet[16:20])
+		payload = packet[headerLength:]
+	case 6:
+		// Extension headers are not followed
+		if len(packet) < 40 || packet[6] != 17 {
+			return udpDatagram{}, false
+		}
+		src, dst = net.IP(packet[8:24]), net.IP(packet[24:40])
+		payload = packet[40:]
+	default:
+		return udpDatagram{}, false
+	}
+
+	if len(payload) < 8 {
+		return udpDatagram{}, false
+	}
+	length := int(binary.BigEndian.Uint16(payload[4:6]))
+	if length < 8 || length > len(payload) {
+		return udpDatagram{}, false
+	}
+
+	return udpDatagram{
+		src:     &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(payload[0:2]))},
+		dst:     &net.UDPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(payload[2:4]))},
+		payload: payload[8:length],
+	}, true
+}
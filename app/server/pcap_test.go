@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// ipv4UDP returns an IPv4 packet from 192.0.2.1:5353 to 192.0.2.53:53
+// carrying payload, with udpLength in the UDP header and fragment in the
+// flags and offset field
+func ipv4UDP(payload []byte, udpLength int, fragment uint16) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[6:], fragment)
+	packet[9] = 17
+	copy(packet[12:], []byte{192, 0, 2, 1})
+	copy(packet[16:], []byte{192, 0, 2, 53})
+	binary.BigEndian.PutUint16(packet[20:], 5353)
+	binary.BigEndian.PutUint16(packet[22:], 53)
+	binary.BigEndian.PutUint16(packet[24:], uint16(udpLength))
+	return append(packet, payload...)
+}
+
+// pcapRecord is a record of a test capture: its data and the length written
+// in its header, which a corrupt file may get wrong
+type pcapRecord struct {
+	data   []byte
+	length uint32
+}
+
+// pcapFile returns a little-endian capture of raw IPv4 packets
+func pcapFile(snapLen uint32, records ...pcapRecord) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, 0xa1b2c3d4)
+	buf = append(buf, 2, 0, 4, 0)
+	buf = append(buf, make([]byte, 8)...)
+	buf = binary.LittleEndian.AppendUint32(buf, snapLen)
+	buf = binary.LittleEndian.AppendUint32(buf, linkTypeIPv4)
+	for _, rec := range records {
+		buf = append(buf, make([]byte, 8)...)
+		buf = binary.LittleEndian.AppendUint32(buf, rec.length)
+		buf = binary.LittleEndian.AppendUint32(buf, rec.length)
+		buf = append(buf, rec.data...)
+	}
+	return buf
+}
+
+// record returns a well-formed record holding packet
+func record(packet []byte) pcapRecord {
+	return pcapRecord{data: packet, length: uint32(len(packet))}
+}
+
+func TestReadPcapBounds(t *testing.T) {
+	payload := []byte("dns")
+	valid := ipv4UDP(payload, 8+len(payload), 0)
+	tests := []struct {
+		name      string
+		file      []byte
+		datagrams int
+		wantErr   bool
+	}{
+		{"valid", pcapFile(65535, record(valid)), 1, false},
+		{"record longer than the snapshot length", pcapFile(16, record(valid)), 0, true},
+		{"record longer than an IP packet is skipped", pcapFile(1<<20, record(make([]byte, maxPcapRecord+1)), record(valid)), 1, false},
+		{"record cut short", pcapFile(65535, pcapRecord{data: valid, length: uint32(len(valid)) + 10}), 0, true},
+		{"UDP length past the packet", pcapFile(65535, record(ipv4UDP(payload, 8+len(payload)+1, 0))), 0, false},
+		{"UDP length below its header", pcapFile(65535, record(ipv4UDP(payload, 7, 0))), 0, false},
+		{"IP fragment", pcapFile(65535, record(ipv4UDP(payload, 8+len(payload), 0x2000))), 0, false},
+		{"IPv4 header cut", pcapFile(65535, record(valid[:19])), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datagrams, err := readPcap(bytes.NewReader(tt.file))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if len(datagrams) != tt.datagrams {
+				t.Fatalf("%d datagrams, want %d", len(datagrams), tt.datagrams)
+			}
+			for _, d := range datagrams {
+				if !bytes.Equal(d.payload, payload) || d.dst.Port != 53 {
+					t.Errorf("datagram %v %q, want port 53 carrying %q", d.dst, d.payload, payload)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import "fmt"
+
+// OverflowPolicy decides what happens to a packet that arrives while the
+// worker pool queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowDrop silently discards the packet; the client will retry
+	OverflowDrop OverflowPolicy = iota
+	// OverflowBlock stops reading from the socket until a worker frees a slot,
+	// pushing back on the kernel receive buffer instead
+	OverflowBlock
+	// OverflowRefuse answers the packet with REFUSED straight from the read
+	// loop so the client fails fast
+	OverflowRefuse
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDrop:
+		return "drop"
+	case OverflowBlock:
+		return "block"
+	case OverflowRefuse:
+		return "refuse"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// WithWorkers processes packets on a fixed pool of n goroutines instead of
+// one goroutine per packet, bounding concurrency under load
+func WithWorkers(n int) Option {
+	return func(s *DNSServer) {
+		s.workers = n
+	}
+}
+
+// WithQueueSize sets how many packets may wait for a free worker before the
+// overflow policy applies. Defaults to 4 times the number of workers
+func WithQueueSize(n int) Option {
+	return func(s *DNSServer) {
+		s.queueSize = n
+	}
+}
+
+// WithOverflowPolicy sets what happens to packets when the queue is full.
+// Defaults to OverflowDrop
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(s *DNSServer) {
+		s.overflow = policy
+	}
+}
+
+// packetJob is a received packet waiting to be handled by a worker
+type packetJob struct {
+	w      ResponseWriter
+	packet []byte
+	done   func()
+}
+
+// startWorkers starts the worker pool and returns its queue. Workers exit
+// once the queue is closed
+func (s *DNSServer) startWorkers() chan packetJob {
+	size := s.queueSize
+	if size <= 0 {
+		size = 4 * s.workers
+	}
+	queue := make(chan packetJob, size)
+
+	for i := 0; i < s.workers; i++ {
+		go func() {
+			for job := range queue {
+				s.handlePacket(job.w, job.packet)
+				job.done()
+			}
+		}()
+	}
+	return queue
+}
+
+// enqueue hands a packet to the worker pool, applying the overflow policy
+// when the queue is full. Returns whether the packet was queued
+func (s *DNSServer) enqueue(queue chan packetJob, job packetJob) bool {
+	if s.overflow == OverflowBlock {
+		queue <- job
+		return true
+	}
+
+	select {
+	case queue <- job:
+		return true
+	default:
+	}
+
+	s.overflowed.Add(1)
+	if s.overflow != OverflowRefuse {
+		return false
+	}
+
+	header, _, err := ParseHeader(job.packet)
+	if err != nil {
+		return false
+	}
+	s.writeMsg(job.w, newErrorReply(&Message{Header: header}, RCodeRefused))
+	return false
+}
+
+// Overflowed returns how many packets were dropped or refused because the
+// worker pool queue was full
+func (s *DNSServer) Overflowed() uint64 {
+	return s.overflowed.Load()
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"encoding/binary"
+	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -18,6 +20,12 @@ type Question struct {
 	Name  string       // Domain name being queried (e.g. "example.com")
 	Type  QuestionType // Record type being requested (e.g. A, AAAA, MX)
 	Class uint16       // Class of the query (usually 1 for Internet)
+
+	// raw holds the question as it was parsed, uncompressed, if its name has
+	// a label that the dotted Name cannot represent, and rawName the Name it
+	// decoded to. Replies echo raw as long as the question is unchanged
+	raw     []byte
+	rawName string
 }
 
 // QuestionType represents the type of DNS record being requested
@@ -25,48 +33,148 @@ type QuestionType uint16
 
 // DNS Question Type constants as defined in RFC 1035
 const (
-	A     QuestionType = 1  // IPv4 host address
-	NS    QuestionType = 2  // Authoritative name server
-	MD    QuestionType = 3  // Mail destination (obsolete)
-	MF    QuestionType = 4  // Mail forwarder (obsolete)
-	CNAME QuestionType = 5  // Canonical name for an alias
-	SOA   QuestionType = 6  // Start of a zone of authority
-	MB    QuestionType = 7  // Mailbox domain name
-	MG    QuestionType = 8  // Mail group member
-	MR    QuestionType = 9  // Mail rename domain name
-	NULL  QuestionType = 10 // Null resource record
-	WKS   QuestionType = 11 // Well known service
-	PTR   QuestionType = 12 // Domain name pointer
-	MX    QuestionType = 15 // Mail exchange
-	TXT   QuestionType = 16 // Text strings
-	AAAA  QuestionType = 28 // IPv6 host address
+	A     QuestionType = 1   // IPv4 host address
+	NS    QuestionType = 2   // Authoritative name server
+	MD    QuestionType = 3   // Mail destination (obsolete)
+	MF    QuestionType = 4   // Mail forwarder (obsolete)
+	CNAME QuestionType = 5   // Canonical name for an alias
+	SOA   QuestionType = 6   // Start of a zone of authority
+	MB    QuestionType = 7   // Mailbox domain name
+	MG    QuestionType = 8   // Mail group member
+	MR    QuestionType = 9   // Mail rename domain name
+	NULL  QuestionType = 10  // Null resource record
+	WKS   QuestionType = 11  // Well known service
+	PTR   QuestionType = 12  // Domain name pointer
+	MX    QuestionType = 15  // Mail exchange
+	TXT   QuestionType = 16  // Text strings
+	AAAA  QuestionType = 28  // IPv6 host address
+	OPT   QuestionType = 41  // EDNS(0) pseudo-record (RFC 6891)
+	ANY   QuestionType = 255 // Request for all records (QTYPE only)
 )
 
+// Later types whose RDATA holds domain names, see canonicalLayouts
+const (
+	MINFO QuestionType = 14 // Mailbox or mail list information (RFC 1035)
+	RP    QuestionType = 17 // Responsible person (RFC 1183)
+	AFSDB QuestionType = 18 // AFS database location (RFC 1183)
+	RT    QuestionType = 21 // Route through (RFC 1183)
+	SIG   QuestionType = 24 // Signature (RFC 2535, obsolete)
+	PX    QuestionType = 26 // X.400 mail mapping (RFC 2163)
+	NXT   QuestionType = 30 // Next domain (RFC 2535, obsolete)
+	SRV   QuestionType = 33 // Service locator (RFC 2782)
+	NAPTR QuestionType = 35 // Naming authority pointer (RFC 3403)
+	KX    QuestionType = 36 // Key exchanger (RFC 2230)
+	A6    QuestionType = 38 // IPv6 address chain (RFC 2874, historic)
+	DNAME QuestionType = 39 // Redirection of a subtree (RFC 6672)
+	RRSIG QuestionType = 46 // DNSSEC signature (RFC 4034)
+	NSEC  QuestionType = 47 // DNSSEC next secure record (RFC 4034)
+)
+
+// NSEC3 is the hashed DNSSEC denial of existence record (RFC 5155)
+const NSEC3 QuestionType = 50
+
+// questionTypeNames maps the types the server knows about to their mnemonics
+var questionTypeNames = map[QuestionType]string{
+	A:     "A",
+	NS:    "NS",
+	MD:    "MD",
+	MF:    "MF",
+	CNAME: "CNAME",
+	SOA:   "SOA",
+	MB:    "MB",
+	MG:    "MG",
+	MR:    "MR",
+	NULL:  "NULL",
+	WKS:   "WKS",
+	PTR:   "PTR",
+	MINFO: "MINFO",
+	MX:    "MX",
+	TXT:   "TXT",
+	RP:    "RP",
+	AFSDB: "AFSDB",
+	RT:    "RT",
+	SIG:   "SIG",
+	PX:    "PX",
+	AAAA:  "AAAA",
+	NXT:   "NXT",
+	SRV:   "SRV",
+	NAPTR: "NAPTR",
+	KX:    "KX",
+	A6:    "A6",
+	DNAME: "DNAME",
+	RRSIG: "RRSIG",
+	NSEC:  "NSEC",
+	NSEC3: "NSEC3",
+	OPT:   "OPT",
+	ANY:   "ANY",
+}
+
 // String returns a string representation of the question type
+// Types without a mnemonic use the generic TYPEnnn form of RFC 3597 §5
 func (qt QuestionType) String() string {
-	switch qt {
-	case A:
-		return "A"
-	case NS:
-		return "NS"
-	case CNAME:
-		return "CNAME"
-	case MX:
-		return "MX"
-	case TXT:
-		return "TXT"
-	case AAAA:
-		return "AAAA"
+	if name, ok := questionTypeNames[qt]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", uint16(qt))
+}
+
+// Known reports whether the server has a mnemonic for the type. Records of
+// unknown types are still parsed and re-serialized with their RDATA untouched
+func (qt QuestionType) Known() bool {
+	_, ok := questionTypeNames[qt]
+	return ok
+}
+
+// ParseQuestionType parses a type mnemonic such as "AAAA" or the generic
+// "TYPE99" form of RFC 3597 §5
+func ParseQuestionType(s string) (QuestionType, error) {
+	s = strings.ToUpper(s)
+	for qt, name := range questionTypeNames {
+		if name == s {
+			return qt, nil
+		}
+	}
+	if rest, ok := strings.CutPrefix(s, "TYPE"); ok {
+		n, err := strconv.ParseUint(rest, 10, 16)
+		if err == nil {
+			return QuestionType(n), nil
+		}
+	}
+	return 0, fmt.Errorf("dns: unknown type %q", s)
+}
+
+// ClassString returns the mnemonic of a DNS class, or the generic CLASSnnn
+// form of RFC 3597 §5 for classes without one
+func ClassString(class uint16) string {
+	switch class {
+	case 1:
+		return "IN"
+	case 3:
+		return "CH"
+	case 4:
+		return "HS"
+	case 254:
+		return "NONE"
+	case 255:
+		return "ANY"
 	default:
-		return "UNKNOWN"
+		return fmt.Sprintf("CLASS%d", class)
 	}
 }
 
 // ParseQuestion parses a DNS question from a byte buffer starting at the given offset
 // Returns the parsed Question and the new offset after the question
-func ParseQuestion(buf []byte, offset int) (*Question, int) {
+func ParseQuestion(buf []byte, offset int) (*Question, int, error) {
 	// Parse the domain name
-	domainName, newOffset := ParseDomainName(buf, offset)
+	labels, newOffset, err := parseLabels(buf, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Type and class are 2 bytes each
+	if err := need(buf, newOffset, 4, "question type and class"); err != nil {
+		return nil, 0, err
+	}
 
 	// Get the type (2 bytes)
 	qType := QuestionType(binary.BigEndian.Uint16(buf[newOffset : newOffset+2]))
@@ -76,23 +184,78 @@ func ParseQuestion(buf []byte, offset int) (*Question, int) {
 	class := binary.BigEndian.Uint16(buf[newOffset : newOffset+2])
 	newOffset += 2
 
-	return &Question{
-		Name:  domainName,
+	q := &Question{
+		Name:  strings.Join(labels, "."),
 		Type:  qType,
 		Class: class,
-	}, newOffset
+	}
+
+	// A dot inside a label would turn into a label boundary when Name is
+	// encoded again, so such questions keep their exact bytes to be echoed
+	for _, label := range labels {
+		if strings.Contains(label, ".") {
+			q.raw = appendLabels(nil, labels)
+			q.raw = append(q.raw, buf[newOffset-4:newOffset]...)
+			q.rawName = q.Name
+			break
+		}
+	}
+	return q, newOffset, nil
+}
+
+// appendLabels appends labels to buf as an uncompressed wire format name
+func appendLabels(buf []byte, labels []string) []byte {
+	for _, label := range labels {
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0)
 }
 
+// maxNameLength is the most octets a name may take in wire format, its
+// length bytes and terminating zero included (RFC 1035 §2.3.4)
+const maxNameLength = 255
+
+// maxLabelLength is the most octets a single label may hold (RFC 1035 §2.3.4)
+const maxLabelLength = 63
+
+// maxPointerFollows bounds how many compression pointers a single name may
+// chain through. A name is at most maxNameLength bytes, so a legitimate
+// message never needs more than 127 pointers to spell one
+const maxPointerFollows = 127
+
 // ParseDomainName parses a domain name from DNS wire format
 // DNS domain names are encoded as a series of labels
 // Each label starts with a length byte followed by that number of bytes for the label text
 // A zero-length label (0 byte) indicates the end of the domain name
 // Returns the domain name as a string and the new offset in the buffer
-func ParseDomainName(buf []byte, offset int) (string, int) {
+func ParseDomainName(buf []byte, offset int) (string, int, error) {
+	labels, newOffset, err := parseLabels(buf, offset)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Join all labels with dots to form the domain name
+	return strings.Join(labels, "."), newOffset, nil
+}
+
+// parseLabels parses a domain name like ParseDomainName, returning its labels
+// rather than joining them
+func parseLabels(buf []byte, offset int) ([]string, int, error) {
 	currentOffset := offset
+	// Offset just after the name in the original position, set once the first
+	// pointer is followed
+	endOffset := -1
+	follows := 0
+	visited := make(map[int]bool)
 	var labels []string
+	// The name's length once uncompressed, counting the terminating zero
+	length := 1
 
 	for {
+		if err := need(buf, currentOffset, 1, "label length"); err != nil {
+			return nil, 0, err
+		}
 		labelLength := int(buf[currentOffset])
 		currentOffset++
 
@@ -104,36 +267,86 @@ func ParseDomainName(buf []byte, offset int) (string, int) {
 		// If the top two bits of the length byte are set (value >= 192),
 		// this is a pointer to another location in the message
 		if labelLength >= 192 {
+			if err := need(buf, currentOffset, 1, "compression pointer"); err != nil {
+				return nil, 0, err
+			}
+
 			// Remove the top two bits to get the offset value
 			// The pointer is 14 bits: 6 from the first byte (after removing top 2 bits) and 8 from the next byte
 			pointerOffset := int(((uint16(labelLength) & 0x3F) << 8) | uint16(buf[currentOffset]))
 			currentOffset++
 
-			// Recursively parse the domain name from the pointer location
-			pointerName, _ := ParseDomainName(buf, pointerOffset)
+			// A pointer to an offset we already read from can only loop, and
+			// a long chain of pointers is a decompression bomb
+			follows++
+			if visited[pointerOffset] || follows > maxPointerFollows {
+				return nil, 0, fmt.Errorf("dns: compression pointer loop at offset %d", currentOffset-2)
+			}
+			visited[pointerOffset] = true
 
-			// Append the name from the pointer and we're done
-			if len(labels) > 0 {
-				return strings.Join(labels, ".") + "." + pointerName, currentOffset
+			if endOffset < 0 {
+				endOffset = currentOffset
 			}
-			return pointerName, currentOffset
+
+			// Continue reading labels from the pointer location
+			currentOffset = pointerOffset
+			continue
+		}
+
+		// The 0x40 and 0x80 prefixes are reserved (RFC 6891 §5)
+		if labelLength > maxLabelLength {
+			return nil, 0, fmt.Errorf("dns: invalid label length %d at offset %d", labelLength, currentOffset-1)
+		}
+
+		length += 1 + labelLength
+		if length > maxNameLength {
+			return nil, 0, fmt.Errorf("dns: name at offset %d longer than %d bytes", offset, maxNameLength)
 		}
 
 		// Normal case: extract the label and add to our list
+		if err := need(buf, currentOffset, labelLength, "label"); err != nil {
+			return nil, 0, err
+		}
 		label := string(buf[currentOffset : currentOffset+labelLength])
 		labels = append(labels, label)
 		currentOffset += labelLength
 	}
 
-	// Join all labels with dots to form the domain name
-	return strings.Join(labels, "."), currentOffset
+	if endOffset < 0 {
+		endOffset = currentOffset
+	}
+
+	return labels, endOffset, nil
+}
+
+// checkDomainName returns an error if name cannot be written in wire format,
+// because a label is longer than maxLabelLength or the whole name longer than
+// maxNameLength. Empty labels are skipped as they are when encoding
+func checkDomainName(name string) error {
+	length := 1
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("dns: label %q longer than %d bytes", label, maxLabelLength)
+		}
+		if len(label) > 0 {
+			length += 1 + len(label)
+		}
+	}
+	if length > maxNameLength {
+		return fmt.Errorf("dns: name %q longer than %d bytes", name, maxNameLength)
+	}
+	return nil
 }
 
 // EncodeDomainName converts a domain name string (e.g., "example.com")
-// to DNS wire format with length-prefixed labels
-func EncodeDomainName(domainName string) []byte {
+// to DNS wire format with length-prefixed labels. Fails if the name is too
+// long for the wire, see checkDomainName
+func EncodeDomainName(domainName string) ([]byte, error) {
 	if domainName == "" || domainName == "." {
-		return []byte{0} // Root domain
+		return []byte{0}, nil // Root domain
+	}
+	if err := checkDomainName(domainName); err != nil {
+		return nil, err
 	}
 
 	// Split the domain name into labels
@@ -168,28 +381,35 @@ func EncodeDomainName(domainName string) []byte {
 	// Terminate with a zero byte
 	buf[offset] = 0
 
-	return buf
+	return buf, nil
 }
 
 // Marshal serializes the Question into DNS wire format
-func (q *Question) Marshal() []byte {
-	// Encode the domain name
-	nameBuf := EncodeDomainName(q.Name)
-
-	// Allocate buffer for the whole question
-	// name + 2 bytes for type + 2 bytes for class
-	buf := make([]byte, len(nameBuf)+4)
+func (q *Question) Marshal() ([]byte, error) {
+	return q.appendTo(nil, nil)
+}
 
-	// Copy the encoded name
-	copy(buf, nameBuf)
-	offset := len(nameBuf)
+// appendTo appends the Question in DNS wire format to the message in buf,
+// compressing its name against comp when it is not nil. The name keeps its
+// original case, as 0x20 randomisation checks expect, and a parsed question
+// whose labels contain dots is echoed byte for byte while unmodified; its
+// name is left out of comp as its dotted form is ambiguous
+func (q *Question) appendTo(buf []byte, comp compressionMap) ([]byte, error) {
+	if q.raw != nil && q.Name == q.rawName &&
+		binary.BigEndian.Uint16(q.raw[len(q.raw)-4:]) == uint16(q.Type) &&
+		binary.BigEndian.Uint16(q.raw[len(q.raw)-2:]) == q.Class {
+		return append(buf, q.raw...), nil
+	}
 
-	// Write the type
-	binary.BigEndian.PutUint16(buf[offset:offset+2], uint16(q.Type))
-	offset += 2
+	// Encode the domain name
+	buf, err := appendDomainName(buf, q.Name, comp)
+	if err != nil {
+		return nil, err
+	}
 
-	// Write the class
-	binary.BigEndian.PutUint16(buf[offset:offset+2], q.Class)
+	// Write the type and class
+	buf = binary.BigEndian.AppendUint16(buf, uint16(q.Type))
+	buf = binary.BigEndian.AppendUint16(buf, q.Class)
 
-	return buf
+	return buf, nil
 }
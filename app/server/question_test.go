@@ -0,0 +1,100 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+// longName returns a name of the given number of 63-byte labels under
+// example.com
+func longName(labels int) string {
+	return strings.Repeat(strings.Repeat("a", 63)+".", labels) + "example.com"
+}
+
+func TestEncodeDomainNameLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		domain  string
+		wantErr bool
+	}{
+		{"root", ".", false},
+		{"63-byte label", strings.Repeat("a", 63) + ".com", false},
+		{"64-byte label", strings.Repeat("a", 64) + ".com", true},
+		{"255 bytes", longName(3) + "." + strings.Repeat("b", 49), false},
+		{"longer than 255 bytes", longName(4), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := EncodeDomainName(tt.domain)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncodeDomainName error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && len(encoded) > maxNameLength {
+				t.Errorf("encoded to %d bytes", len(encoded))
+			}
+
+			// The compressing encoder used by Marshal refuses the same names
+			_, err = appendDomainName(nil, tt.domain, make(compressionMap))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("appendDomainName error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMarshalRefusesLongNames(t *testing.T) {
+	m := NewQuery(1, "example.com", A, false)
+	m.Answers = []*ResourceRecord{{Name: longName(4), Type: A, Class: 1, Data: []byte{192, 0, 2, 1}}}
+	if _, err := m.Marshal(); err == nil {
+		t.Error("Marshal accepted an owner name longer than 255 bytes")
+	}
+	if _, _, err := m.MarshalTruncated(maxUDPSize); err == nil {
+		t.Error("MarshalTruncated accepted an owner name longer than 255 bytes")
+	}
+}
+
+// label returns the wire format of a single label of n bytes
+func label(n int) []byte {
+	return append([]byte{byte(n)}, strings.Repeat("a", n)...)
+}
+
+// pointerChain returns a root name followed by n pointers each pointing at
+// the one before, and the offset of the last
+func pointerChain(n int) ([]byte, int) {
+	buf := []byte{0}
+	prev := 0
+	for range n {
+		at := len(buf)
+		buf = append(buf, 0xC0|byte(prev>>8), byte(prev))
+		prev = at
+	}
+	return buf, prev
+}
+
+func TestParseDomainNameLimits(t *testing.T) {
+	chain127, last127 := pointerChain(maxPointerFollows)
+	chain128, last128 := pointerChain(maxPointerFollows + 1)
+	tests := []struct {
+		name    string
+		buf     []byte
+		offset  int
+		wantErr bool
+	}{
+		{"plain name", wireName("www.example.com"), 0, false},
+		{"pointer to itself", []byte{0xC0, 0x00}, 0, true},
+		{"two pointers in a loop", []byte{0xC0, 0x02, 0xC0, 0x00}, 0, true},
+		{"127 chained pointers", chain127, last127, false},
+		{"128 chained pointers", chain128, last128, true},
+		{"255 bytes", rdata(label(63), label(63), label(63), label(61), []byte{0}), 0, false},
+		{"256 bytes", rdata(label(63), label(63), label(63), label(62), []byte{0}), 0, true},
+		{"over 255 bytes through a pointer", rdata(label(63), []byte{0}, label(63), label(63), label(63), []byte{0xC0, 0x00}), 65, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseDomainName(tt.buf, tt.offset)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
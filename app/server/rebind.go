@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// WithRebindProtection rejects forwarded and recursive answers pointing names
+// at private, loopback, link-local or unspecified addresses, see
+// FilterRebinding. Names at or below the allow suffixes may resolve to such
+// addresses, for split-horizon domains served by a local upstream
+func WithRebindProtection(allow ...string) Option {
+	return func(s *DNSServer) {
+		s.rebind = FilterRebinding(allow...)
+	}
+}
+
+// FilterRebinding guards clients against DNS rebinding, where a public name
+// an attacker controls is made to resolve to an address on the client's own
+// network. Replies with RA set, which come from forwarding or recursion, are
+// answered NXDOMAIN with an Extended DNS Error instead if any A or AAAA record
+// in their answers has such an address, unless the question's name is at or
+// below one of the allow suffixes
+func FilterRebinding(allow ...string) Middleware {
+	suffixes := make([]string, len(allow))
+	for i, a := range allow {
+		suffixes[i] = CanonicalName(a)
+	}
+
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			if len(r.Questions) == 0 {
+				next.ServeDNS(w, r)
+				return
+			}
+			name := CanonicalName(r.Questions[0].Name)
+			for _, suffix := range suffixes {
+				if isSubdomain(name, suffix) {
+					next.ServeDNS(w, r)
+					return
+				}
+			}
+			next.ServeDNS(rebindWriter{ResponseWriter: w, query: r}, r)
+		})
+	}
+}
+
+// rebindWriter replaces the replies written through it if they rebind the
+// name asked for
+type rebindWriter struct {
+	ResponseWriter
+	query *Message
+}
+
+func (w rebindWriter) WriteMsg(m *Message) error {
+	if !m.Header.Flag.GetRA() {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+	addr, ok := localAnswer(m)
+	if !ok {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	fmt.Printf("Blocked answer %s for %s to %s: possible DNS rebinding\n",
+		addr, w.query.Questions[0].Name, w.RemoteAddr())
+	reply := NewReply(w.query)
+	reply.Header.Flag.SetRA(true)
+	reply.SetRCode(RCodeNXDomain)
+	reply.SetExtendedError(EDEBlocked, "answer "+addr.String()+" is a local address")
+	return w.ResponseWriter.WriteMsg(reply)
+}
+
+// bogonPrefixes are the ranges that are not publicly routable on top of
+// those the netip.Addr predicates cover
+var bogonPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // This network (RFC 791), reaching the host itself on Linux
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT shared space (RFC 6598)
+}
+
+// nat64Prefix is the well-known NAT64 prefix (RFC 6052). Its addresses reach
+// the IPv4 address in their last 32 bits through the translator
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// localAnswer returns the first address in the answers of m that is not
+// publicly routable
+func localAnswer(m *Message) (netip.Addr, bool) {
+	for _, rr := range m.Answers {
+		if rr.Type != A && rr.Type != AAAA {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(rr.Data)
+		if ok && isLocalAddr(addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// isLocalAddr reports whether addr, or the IPv4 address it embeds, is not
+// publicly routable
+func isLocalAddr(addr netip.Addr) bool {
+	// IPv4-mapped IPv6 addresses reach the IPv4 address they embed, and so do
+	// NAT64 ones
+	addr = addr.Unmap()
+	if nat64Prefix.Contains(addr) {
+		b := addr.As16()
+		addr = netip.AddrFrom4([4]byte(b[12:]))
+	}
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range bogonPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithTTLFloor raises the TTL of forwarded and recursive A and AAAA answers to
+// at least floor for clients in the given networks, see TTLFloor. It can be
+// given once per group of clients
+func WithTTLFloor(floor time.Duration, clients ...netip.Prefix) Option {
+	return func(s *DNSServer) {
+		s.ttlFloors = append(s.ttlFloors, TTLFloor(floor, clients...))
+	}
+}
+
+// TTLFloor raises the TTL of the A and AAAA answers in replies with RA set to
+// at least floor, for clients whose address is in one of the clients
+// networks. Clients that cannot be trusted to defend themselves, such as
+// devices on an IoT network, then keep an address for a while instead of
+// following a name as it hops between addresses, as in fast-flux or rebinding
+// attacks. Replies to other clients are left alone
+func TTLFloor(floor time.Duration, clients ...netip.Prefix) Middleware {
+	ttl := uint32(min(floor, maxCacheTTL) / time.Second)
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Message) {
+			client, ok := clientAddr(w.RemoteAddr())
+			if !ok {
+				next.ServeDNS(w, r)
+				return
+			}
+			for _, prefix := range clients {
+				if prefix.Contains(client) {
+					next.ServeDNS(ttlFloorWriter{ResponseWriter: w, ttl: ttl}, r)
+					return
+				}
+			}
+			next.ServeDNS(w, r)
+		})
+	}
+}
+
+// ttlFloorWriter raises the TTL of the address answers in the replies written
+// through it to at least ttl seconds
+type ttlFloorWriter struct {
+	ResponseWriter
+	ttl uint32
+}
+
+func (w ttlFloorWriter) WriteMsg(m *Message) error {
+	if !m.Header.Flag.GetRA() {
+		return w.ResponseWriter.WriteMsg(m)
+	}
+
+	// The answers may be shared with the cache, which must keep the real TTLs,
+	// so the reply gets copies
+	raised := *m
+	raised.Answers = make([]*ResourceRecord, len(m.Answers))
+	for i, rr := range m.Answers {
+		raised.Answers[i] = rr
+		if (rr.Type == A || rr.Type == AAAA) && rr.TTL < w.ttl {
+			copied := *rr
+			copied.TTL = w.ttl
+			raised.Answers[i] = &copied
+		}
+	}
+	return w.ResponseWriter.WriteMsg(&raised)
+}
+
+// clientAddr returns the IP address of a client, unmapped so IPv4 clients
+// match IPv4 networks on dual-stack sockets
+func clientAddr(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	client, ok := netip.AddrFromSlice(ip)
+	return client.Unmap(), ok
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestIsLocalAddr(t *testing.T) {
+	tests := []struct {
+		addr  string
+		local bool
+	}{
+		{"192.0.2.1", false},
+		{"8.8.8.8", false},
+		{"10.1.2.3", true},
+		{"127.0.0.1", true},
+		{"169.254.1.1", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"100.128.0.1", false},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"2001:db8::1", false},
+		{"::ffff:192.168.1.1", true},
+		{"::ffff:8.8.8.8", false},
+		{"64:ff9b::c0a8:101", true}, // NAT64 of 192.168.1.1
+		{"64:ff9b::a00:1", true},    // NAT64 of 10.0.0.1
+		{"64:ff9b::6440:1", true},   // NAT64 of 100.64.0.1
+		{"64:ff9b::808:808", false}, // NAT64 of 8.8.8.8
+		{"64:ff9b:1::a00:1", false}, // outside the well-known prefix
+	}
+	for _, tt := range tests {
+		if got := isLocalAddr(netip.MustParseAddr(tt.addr)); got != tt.local {
+			t.Errorf("isLocalAddr(%s) = %t, want %t", tt.addr, got, tt.local)
+		}
+	}
+}
+
+func TestFilterRebinding(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		answer net.IP
+		ra     bool
+		rcode  RCode
+	}{
+		{"public answer", "www.example.com", net.ParseIP("192.0.2.1"), true, RCodeNoError},
+		{"local answer", "www.example.com", net.ParseIP("10.0.0.1"), true, RCodeNXDomain},
+		{"NAT64 local answer", "www.example.com", net.ParseIP("64:ff9b::a00:1"), true, RCodeNXDomain},
+		{"allowed suffix", "nas.home.arpa", net.ParseIP("10.0.0.1"), true, RCodeNoError},
+		{"local data", "www.example.com", net.ParseIP("10.0.0.1"), false, RCodeNoError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Chain(HandlerFunc(func(w ResponseWriter, r *Message) {
+				reply := NewReply(r)
+				reply.Header.Flag.SetRA(tt.ra)
+				rr := NewARecord(tt.qname, tt.answer, 300)
+				if ip4 := tt.answer.To4(); ip4 != nil {
+					rr.Data = ip4
+				} else {
+					rr.Type, rr.Data = AAAA, tt.answer.To16()
+				}
+				reply.Answers = []*ResourceRecord{rr}
+				w.WriteMsg(reply)
+			}), FilterRebinding("home.arpa"))
+			w := &testWriter{}
+			h.ServeDNS(w, testQuery(tt.qname, A, false))
+			if got := w.replies[0].RCode(); got != tt.rcode {
+				t.Errorf("rcode %s, want %s", got, tt.rcode)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultRootHints are the IPv4 addresses of the root servers, a to m
+// (https://www.iana.org/domains/root/files)
+var defaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+const (
+	// recurseTimeout bounds the full resolution of a client query, which may
+	// walk several levels of referrals
+	recurseTimeout = 5 * time.Second
+
+	// maxReferrals is how many referrals a single lookup may follow
+	maxReferrals = 16
+
+	// maxRecursionDepth is how deeply lookups may nest, each CNAME followed or
+	// name server address looked up adding a level
+	maxRecursionDepth = 8
+)
+
+// Recursor is a Handler that resolves queries itself, starting from the root
+// servers and following referrals down to the authoritative servers of each
+// name. Nothing is cached, so every query walks from the root
+type Recursor struct {
+	roots []*upstream
+	pool  *ConnPool
+}
+
+// NewRecursor builds a Recursor starting from the root servers at roots, or
+// the IANA root servers if none are given. Each is an address, port 53 if
+// omitted
+func NewRecursor(roots ...string) *Recursor {
+	if len(roots) == 0 {
+		roots = defaultRootHints
+	}
+	r := &Recursor{pool: NewConnPool(defaultMaxConnsPerHost, defaultPoolIdleTimeout)}
+	for _, root := range roots {
+		r.roots = append(r.roots, r.server(withDefaultPort(root, "53")))
+	}
+	return r
+}
+
+func (r *Recursor) String() string {
+	return "recursion"
+}
+
+// server returns an upstream for the name server at addr
+func (r *Recursor) server(addr string) *upstream {
+	return &upstream{addr: addr, transport: plainTransport{addr: addr, pool: r.pool}}
+}
+
+// ServeDNS resolves the questions of req and replies with the merged answers.
+// Queries with RD unset are not resolved and get an empty reply, as for the
+// Forwarder
+func (r *Recursor) ServeDNS(w ResponseWriter, req *Message) {
+	reply := NewReply(req)
+	reply.Header.Flag.SetRA(true)
+
+	switch {
+	case req.Header.Flag.GetOPCode() != QUERY:
+		// Only standard queries are supported
+		reply.SetRCode(RCodeNotImp)
+	case req.Header.Flag.GetRD():
+		resolveQuestions(req, reply, recurseTimeout, r, r.Resolve)
+	}
+
+	if err := w.WriteMsg(reply); err != nil {
+		fmt.Printf("Failed to reply to %s: %v\n", w.RemoteAddr(), err)
+	}
+}
+
+// Resolve looks up a single question starting from the root servers. cd is
+// ignored as answers are not validated; do sets the DNSSEC OK bit of the
+// queries for q, so the answers carry their signatures
+func (r *Recursor) Resolve(ctx context.Context, q *Question, cd, do bool) (*Message, error) {
+	return r.resolve(ctx, q, do, 0)
+}
+
+// resolve looks up q, asking the servers of each zone cut in turn from the
+// root down, and chases CNAMEs to their target
+func (r *Recursor) resolve(ctx context.Context, q *Question, do bool, depth int) (*Message, error) {
+	if depth > maxRecursionDepth {
+		return nil, fmt.Errorf("dns: lookup of %s nested too deeply", q.Name)
+	}
+
+	name := CanonicalName(q.Name)
+	servers, zone := r.roots, ""
+	for range maxReferrals {
+		reply, err := r.query(ctx, servers, q, do)
+		if err != nil {
+			return nil, err
+		}
+		if reply.RCode() != RCodeNoError || len(reply.Answers) > 0 {
+			return r.chase(ctx, reply, q, do, zone, depth)
+		}
+
+		cut, names := referral(reply, zone, name)
+		if cut == "" {
+			// No data for the name and type
+			return reply, nil
+		}
+		if servers, err = r.serversFor(ctx, reply, zone, names, depth); err != nil {
+			return nil, fmt.Errorf("dns: name servers of %s: %w", cut, err)
+		}
+		zone = cut
+	}
+	return nil, fmt.Errorf("dns: too many referrals for %s", q.Name)
+}
+
+// query asks servers in turn for q without recursion, fastest first, until
+// one answers with NOERROR or NXDOMAIN. Returns the last error if none does
+func (r *Recursor) query(ctx context.Context, servers []*upstream, q *Question, do bool) (*Message, error) {
+	err := fmt.Errorf("dns: no name server for %s", q.Name)
+	for _, u := range orderUpstreams(servers) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// Servers are not marked down: apart from the roots they are only
+		// known for the lookup at hand
+		var reply *Message
+		if reply, err = r.queryOne(ctx, u, q, do); err == nil {
+			return reply, nil
+		}
+	}
+	return nil, err
+}
+
+// queryOne asks a single name server for q and checks the reply answers it
+func (r *Recursor) queryOne(ctx context.Context, u *upstream, q *Question, do bool) (*Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, upstreamAttemptTimeout)
+	defer cancel()
+
+	query := NewQuery(randomID(), q.Name, q.Type, true)
+	query.Questions[0].Class = q.Class
+	query.Header.Flag.SetRD(false)
+	setOptDO(query.OPT(), do)
+
+	start := time.Now()
+	reply, err := u.transport.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	u.observe(time.Since(start))
+
+	if rcode := reply.RCode(); rcode != RCodeNoError && rcode != RCodeNXDomain {
+		return nil, fmt.Errorf("dns: name server %s answered %s", u, rcode)
+	}
+	return reply, nil
+}
+
+// referral returns the zone cut reply delegates name to and the names of its
+// name servers, or "" if reply is not a referral. Only cuts below zone, the
+// zone of the servers that answered, are followed, so a server cannot send
+// the lookup back up or sideways
+func referral(reply *Message, zone, name string) (cut string, names []string) {
+	for _, rr := range reply.Authorities {
+		if rr.Type != NS {
+			continue
+		}
+		owner := CanonicalName(rr.Name)
+		if owner == zone || !isSubdomain(owner, zone) || !isSubdomain(name, owner) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+		target, _, err := ParseDomainName(rr.Data, 0)
+		if err != nil {
+			continue
+		}
+		cut = owner
+		names = append(names, CanonicalName(target))
+	}
+	return cut, names
+}
+
+// serversFor returns the name servers called names, using the glue addresses
+// of referral. Glue is only trusted for names within zone, which the servers
+// giving the referral are authoritative for; other names are looked up
+func (r *Recursor) serversFor(ctx context.Context, referral *Message, zone string, names []string, depth int) ([]*upstream, error) {
+	var v4, v6 []*upstream
+	for _, name := range names {
+		if !isSubdomain(name, zone) {
+			continue
+		}
+		for _, rr := range referral.Additionals {
+			if CanonicalName(rr.Name) != name {
+				continue
+			}
+			if rr.Type == A && len(rr.Data) == 4 {
+				v4 = append(v4, r.server(net.JoinHostPort(net.IP(rr.Data).String(), "53")))
+			} else if rr.Type == AAAA && len(rr.Data) == 16 {
+				v6 = append(v6, r.server(net.JoinHostPort(net.IP(rr.Data).String(), "53")))
+			}
+		}
+	}
+	// IPv4 first, as hosts without IPv6 connectivity are still common
+	if servers := append(v4, v6...); len(servers) > 0 {
+		return servers, nil
+	}
+
+	// Without usable glue the names are looked up from the root, stopping at
+	// the first that has addresses
+	err := fmt.Errorf("no address for %s", strings.Join(names, ", "))
+	for _, name := range names {
+		var reply *Message
+		reply, err = r.resolve(ctx, &Question{Name: name, Type: A, Class: 1}, false, depth+1)
+		if err != nil {
+			continue
+		}
+		var servers []*upstream
+		for _, rr := range reply.Answers {
+			if rr.Type == A && len(rr.Data) == 4 {
+				servers = append(servers, r.server(net.JoinHostPort(net.IP(rr.Data).String(), "53")))
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	return nil, err
+}
+
+// chase follows the CNAME chain in the answers of reply to q. Only answers for
+// names within zone, the zone of the server that sent reply, are kept: a
+// server could otherwise plant records for any name behind a CNAME. Once the
+// chain leaves zone, or ends without an answer for its target, the target is
+// looked up from the root and its answers appended after the chain
+func (r *Recursor) chase(ctx context.Context, reply *Message, q *Question, do bool, zone string, depth int) (*Message, error) {
+	trusted := *reply
+	trusted.Answers = nil
+	for _, rr := range reply.Answers {
+		if isSubdomain(CanonicalName(rr.Name), zone) {
+			trusted.Answers = append(trusted.Answers, rr)
+		}
+	}
+	if q.Type == CNAME || reply.RCode() != RCodeNoError {
+		return &trusted, nil
+	}
+
+	// Each step moves to another owner in the answers, so a chain longer than
+	// them loops
+	name := CanonicalName(q.Name)
+	for range len(trusted.Answers) + 1 {
+		target := ""
+		for _, rr := range trusted.Answers {
+			if CanonicalName(rr.Name) != name {
+				continue
+			}
+			if rr.Type == q.Type {
+				return &trusted, nil
+			}
+			if rr.Type == CNAME {
+				if t, _, err := ParseDomainName(rr.Data, 0); err == nil {
+					target = CanonicalName(t)
+				}
+			}
+		}
+		if target == "" {
+			return &trusted, nil
+		}
+		name = target
+
+		// The server answered for the target too if it is in its zone; only
+		// look it up once the chain leaves the trusted answers
+		inReply := false
+		for _, rr := range trusted.Answers {
+			if CanonicalName(rr.Name) == name {
+				inReply = true
+				break
+			}
+		}
+		if inReply {
+			continue
+		}
+
+		next, err := r.resolve(ctx, &Question{Name: name, Type: q.Type, Class: q.Class}, do, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		chased := *next
+		chased.Answers = append(append([]*ResourceRecord(nil), trusted.Answers...), next.Answers...)
+		return &chased, nil
+	}
+	return nil, fmt.Errorf("dns: CNAME loop at %s", q.Name)
+}
+
+// isSubdomain reports whether name is zone or below it. Both must be
+// canonical, and the root zone is ""
+func isSubdomain(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
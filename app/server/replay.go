@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ReplayReport summarises a replay of captured traffic
+type ReplayReport struct {
+	Queries    int              // Queries found in the capture
+	Matched    int              // Queries whose reply matched the captured one
+	Unanswered int              // Queries with no captured reply to compare to
+	Mismatches []ReplayMismatch // Queries whose reply differed
+}
+
+// ReplayMismatch describes a query whose replayed reply differs from the
+// one in the capture
+type ReplayMismatch struct {
+	Query    *Message
+	Original *Message
+	Produced *Message // nil if the handler sent no reply
+	Reason   string
+}
+
+// replayQuery is a captured query waiting for its captured reply
+type replayQuery struct {
+	client   *net.UDPAddr
+	server   *net.UDPAddr
+	packet   []byte
+	query    *Message
+	original *Message
+}
+
+// Replay feeds every DNS query in a pcap capture through the server offline,
+// without opening any socket, and compares each reply to the one captured
+// for the same client and ID. The warm-up steps run first, and each query
+// then goes through the same checks as one read from a socket, such as
+// BADVERS and load shedding, before the handler and middleware chain. Replies
+// are compared after re-encoding both, so differences in name compression
+// don't count
+func (s *DNSServer) Replay(r io.Reader) (*ReplayReport, error) {
+	datagrams, err := readPcap(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var queries []*replayQuery
+	pending := make(map[string]*replayQuery)
+	for _, d := range datagrams {
+		m, err := ParseMessage(d.payload)
+		if err != nil {
+			continue
+		}
+		if !m.Header.Flag.GetQR() {
+			q := &replayQuery{client: d.src, server: d.dst, packet: d.payload, query: m}
+			queries = append(queries, q)
+			pending[replayKey(d.src, m.Header.ID)] = q
+			continue
+		}
+		key := replayKey(d.dst, m.Header.ID)
+		if q, ok := pending[key]; ok {
+			q.original = m
+			delete(pending, key)
+		}
+	}
+
+	chain, _, err := s.buildChain()
+	if err != nil {
+		return nil, err
+	}
+	s.chain = chain
+	s.runWarmup(context.Background())
+
+	report := &ReplayReport{Queries: len(queries)}
+	for _, q := range queries {
+		w := &replayResponseWriter{local: q.server, remote: q.client}
+		s.handlePacket(w, q.packet)
+
+		if q.original == nil {
+			report.Unanswered++
+			continue
+		}
+		if reason := compareReplies(q.original, w.reply); reason != "" {
+			report.Mismatches = append(report.Mismatches, ReplayMismatch{
+				Query:    q.query,
+				Original: q.original,
+				Produced: w.reply,
+				Reason:   reason,
+			})
+			continue
+		}
+		report.Matched++
+	}
+	return report, nil
+}
+
+func replayKey(client *net.UDPAddr, id uint16) string {
+	return fmt.Sprintf("%s/%d", client, id)
+}
+
+// compareReplies returns why produced differs from original, or "" if they
+// encode to the same bytes
+func compareReplies(original, produced *Message) string {
+	if produced == nil {
+		return "no reply produced"
+	}
+	originalWire, originalErr := original.Marshal()
+	producedWire, producedErr := produced.Marshal()
+	if producedErr != nil {
+		return producedErr.Error()
+	}
+	if originalErr == nil && bytes.Equal(originalWire, producedWire) {
+		return ""
+	}
+
+	originalRCode, producedRCode := original.RCode(), produced.RCode()
+	switch {
+	case originalRCode != producedRCode:
+		return fmt.Sprintf("rcode %s, captured %s", producedRCode, originalRCode)
+	case len(original.Answers) != len(produced.Answers):
+		return fmt.Sprintf("%d answers, captured %d", len(produced.Answers), len(original.Answers))
+	}
+	for i := range original.Answers {
+		if o, p := original.Answers[i].String(), produced.Answers[i].String(); o != p {
+			return fmt.Sprintf("answer %d is %q, captured %q", i, p, o)
+		}
+	}
+	return "header flags or other sections differ"
+}
+
+// replayResponseWriter captures the reply a handler produces during replay
+type replayResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	reply  *Message
+}
+
+func (w *replayResponseWriter) WriteMsg(m *Message) error {
+	w.reply = m
+	return nil
+}
+
+func (w *replayResponseWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *replayResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *replayResponseWriter) Network() string {
+	return "replay"
+}
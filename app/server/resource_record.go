@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// ResourceRecord represents a DNS resource record as found in the answer,
+// authority and additional sections
+// DNS Resource Record format:
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                     NAME                       |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                     TYPE                       |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                    CLASS                       |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                     TTL                        |
+// |                                                |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+// |                   RDLENGTH                     |
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--|
+// /                     RDATA                      /
+// +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+type ResourceRecord struct {
+	Name  string       // Domain name the record belongs to
+	Type  QuestionType // Record type (e.g. A, AAAA, MX)
+	Class uint16       // Class of the record (usually 1 for Internet)
+	TTL   uint32       // Time in seconds the record may be cached
+	Data  []byte       // RDATA with names uncompressed, its length is written as RDLENGTH
+}
+
+// NewARecord builds an A record pointing name at the given IPv4 address,
+// which must be one: other addresses leave the RDATA empty
+func NewARecord(name string, ip net.IP, ttl uint32) *ResourceRecord {
+	return &ResourceRecord{
+		Name:  name,
+		Type:  A,
+		Class: 1,
+		TTL:   ttl,
+		Data:  []byte(ip.To4()),
+	}
+}
+
+// ParseResourceRecord parses a DNS resource record from a byte buffer starting at the given offset
+// Returns the parsed ResourceRecord and the new offset after the record
+func ParseResourceRecord(buf []byte, offset int) (*ResourceRecord, int, error) {
+	// Parse the owner name
+	name, newOffset, err := ParseDomainName(buf, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Type, class, TTL and RDLENGTH take 10 bytes
+	if err := need(buf, newOffset, 10, "record fixed fields"); err != nil {
+		return nil, 0, err
+	}
+
+	// Get the type (2 bytes)
+	rrType := QuestionType(binary.BigEndian.Uint16(buf[newOffset : newOffset+2]))
+	newOffset += 2
+
+	// Get the class (2 bytes)
+	class := binary.BigEndian.Uint16(buf[newOffset : newOffset+2])
+	newOffset += 2
+
+	// Get the TTL (4 bytes)
+	ttl := binary.BigEndian.Uint32(buf[newOffset : newOffset+4])
+	newOffset += 4
+
+	// Get the RDATA, prefixed by its 2 byte length
+	rdLength := int(binary.BigEndian.Uint16(buf[newOffset : newOffset+2]))
+	newOffset += 2
+	if err := need(buf, newOffset, rdLength, "rdata"); err != nil {
+		return nil, 0, err
+	}
+	data, err := expandRData(buf, rrType, newOffset, rdLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	newOffset += rdLength
+
+	return &ResourceRecord{
+		Name:  name,
+		Type:  rrType,
+		Class: class,
+		TTL:   ttl,
+		Data:  data,
+	}, newOffset, nil
+}
+
+// GenericData renders the RDATA in the generic format of RFC 3597 §5
+// (e.g. `\# 4 0a000001`), which works for any type including ones the server
+// does not model
+func (rr *ResourceRecord) GenericData() string {
+	if len(rr.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %s`, len(rr.Data), hex.EncodeToString(rr.Data))
+}
+
+// Marshal serializes the ResourceRecord into DNS wire format
+func (rr *ResourceRecord) Marshal() ([]byte, error) {
+	return rr.appendTo(nil, nil)
+}
+
+// appendTo appends the ResourceRecord in DNS wire format to the message in
+// buf, compressing its owner name against comp when it is not nil. RDATA is
+// always written as is, so records of unknown types (RFC 3597) round-trip
+// byte for byte
+func (rr *ResourceRecord) appendTo(buf []byte, comp compressionMap) ([]byte, error) {
+	// Encode the owner name
+	buf, err := appendDomainName(buf, rr.Name, comp)
+	if err != nil {
+		return nil, err
+	}
+
+	// type + class + TTL + RDLENGTH + RDATA
+	buf = binary.BigEndian.AppendUint16(buf, uint16(rr.Type))
+	buf = binary.BigEndian.AppendUint16(buf, rr.Class)
+	buf = binary.BigEndian.AppendUint32(buf, rr.TTL)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(rr.Data)))
+	buf = append(buf, rr.Data...)
+
+	return buf, nil
+}
+
+// expandRData returns a copy of the rdLength bytes of RDATA at offset in buf.
+// Names inside the RDATA of the types in compressibleLayouts may be
+// compressed against the rest of the message, so they are expanded: the
+// pointers would be meaningless once the record is copied into another
+// message, e.g. when forwarding an upstream's answers. Other types are copied
+// as is
+func expandRData(buf []byte, rrType QuestionType, offset, rdLength int) ([]byte, error) {
+	end := offset + rdLength
+
+	layout, ok := compressibleLayouts[rrType]
+	if !ok {
+		data := make([]byte, rdLength)
+		copy(data, buf[offset:end])
+		return data, nil
+	}
+
+	data, err := rewriteRData(buf, offset, end, layout, false)
+	if err != nil {
+		return nil, fmt.Errorf("dns: %s rdata: %w", rrType, err)
+	}
+	return data, nil
+}
+
+// rdataField is one field of an RDATA layout: that many bytes kept as they
+// are when positive, otherwise one of the variable-length fields below
+type rdataField int
+
+const (
+	rdataName   rdataField = -1 - iota // A domain name
+	rdataString                        // A character-string, its length byte first
+	rdataRest                          // Every byte left
+	// The A6 address suffix and prefix name, sized by the prefix length
+	// byte before them (RFC 2874 §3.1)
+	rdataA6
+)
+
+// compressibleLayouts lays out the RDATA of the types whose names may be
+// compressed: the RFC 1035 types, which RFC 3597 §4 says must be expanded,
+// and those it says should be as some servers compress them too
+var compressibleLayouts = map[QuestionType][]rdataField{
+	NS:    {rdataName},
+	MD:    {rdataName},
+	MF:    {rdataName},
+	CNAME: {rdataName},
+	SOA:   {rdataName, rdataName, 20},
+	MB:    {rdataName},
+	MG:    {rdataName},
+	MR:    {rdataName},
+	PTR:   {rdataName},
+	MINFO: {rdataName, rdataName},
+	MX:    {2, rdataName},
+	RP:    {rdataName, rdataName},
+	AFSDB: {2, rdataName},
+	RT:    {2, rdataName},
+	SIG:   {18, rdataName, rdataRest},
+	PX:    {2, rdataName, rdataName},
+	NXT:   {rdataName, rdataRest},
+	SRV:   {6, rdataName},
+	NAPTR: {4, rdataString, rdataString, rdataString, rdataName},
+}
+
+// rewriteRData returns the RDATA between offset and end in buf laid out as
+// layout, with its names uncompressed and, if lower is set, lowercased
+func rewriteRData(buf []byte, offset, end int, layout []rdataField, lower bool) ([]byte, error) {
+	buf = buf[:end]
+	data := make([]byte, 0, end-offset)
+	appendName := func() error {
+		labels, newOffset, err := parseLabels(buf, offset)
+		if err != nil {
+			return err
+		}
+		if lower {
+			for i, label := range labels {
+				labels[i] = lowerASCII(label)
+			}
+		}
+		data = appendLabels(data, labels)
+		offset = newOffset
+		return nil
+	}
+
+	for _, field := range layout {
+		size := int(field)
+		switch field {
+		case rdataName:
+			if err := appendName(); err != nil {
+				return nil, err
+			}
+			continue
+		case rdataString:
+			if err := need(buf, offset, 1, "character-string length"); err != nil {
+				return nil, err
+			}
+			size = 1 + int(buf[offset])
+		case rdataRest:
+			size = end - offset
+		case rdataA6:
+			// Follows the prefix length byte. The prefix name is only there
+			// when the prefix is not empty
+			prefixLength := int(buf[offset-1])
+			if prefixLength > 128 {
+				return nil, fmt.Errorf("dns: A6 prefix length %d over 128", prefixLength)
+			}
+			size = (128 - prefixLength + 7) / 8
+			if err := need(buf, offset, size, "A6 address suffix"); err != nil {
+				return nil, err
+			}
+			data = append(data, buf[offset:offset+size]...)
+			offset += size
+			if prefixLength > 0 {
+				if err := appendName(); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err := need(buf, offset, size, "rdata field"); err != nil {
+			return nil, err
+		}
+		data = append(data, buf[offset:offset+size]...)
+		offset += size
+	}
+	if offset != end {
+		return nil, fmt.Errorf("dns: %d bytes left after the last rdata field", end-offset)
+	}
+	return data, nil
+}
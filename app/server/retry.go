@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// defaultRetries is how many more rounds over the upstreams are made
+	// after the first one fails
+	defaultRetries = 1
+
+	// Backoff bounds between rounds: the wait doubles with each round, up to
+	// the maximum
+	defaultRetryBackoff    = 50 * time.Millisecond
+	defaultMaxRetryBackoff = time.Second
+)
+
+// WithRetries makes up to n more rounds over the upstreams when every one of
+// them failed to answer a question, waiting out a backoff before each. n of 0
+// gives up after the first round
+func WithRetries(n int) ForwarderOption {
+	return func(f *Forwarder) {
+		f.retries = max(n, 0)
+	}
+}
+
+// WithAttemptTimeout bounds a single query to one upstream, after which the
+// next one is tried
+func WithAttemptTimeout(d time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.attemptTimeout = d
+	}
+}
+
+// WithDeadline bounds the time spent resolving a client query over every
+// round and upstream, after which the client gets SERVFAIL
+func WithDeadline(d time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.timeout = d
+	}
+}
+
+// WithBackoff sets the wait before the first retry round to base, doubling
+// with each later round up to maxBackoff. Each wait is jittered down by up to
+// half so clients failing together do not retry in lockstep
+func WithBackoff(base, maxBackoff time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.backoff = base
+		f.maxBackoff = maxBackoff
+	}
+}
+
+// exhaustedError reports that every round of attempts to resolve a question
+// failed, wrapping the last failure. expired is set if the deadline ended them
+type exhaustedError struct {
+	rounds  int
+	expired bool
+	err     error
+}
+
+func (e *exhaustedError) Error() string {
+	return fmt.Sprintf("all %d rounds of attempts failed, last: %v", e.rounds, e.err)
+}
+
+func (e *exhaustedError) Unwrap() error {
+	return e.err
+}
+
+// resolveRetrying runs resolve until it succeeds or the retry rounds or ctx
+// run out, backing off between rounds. A backoff that would outlast ctx's
+// deadline ends the retries early
+func (f *Forwarder) resolveRetrying(ctx context.Context, resolve func() (*Message, error)) (*Message, error) {
+	var err error
+	rounds := 0
+	for round := range f.retries + 1 {
+		if round > 0 {
+			wait := f.retryBackoff(round)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				break
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		rounds++
+		var reply *Message
+		if reply, err = resolve(); err == nil {
+			return reply, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, &exhaustedError{rounds: rounds, expired: ctx.Err() != nil, err: err}
+}
+
+// retryBackoff returns the jittered wait before retry round n, counting from 1
+func (f *Forwarder) retryBackoff(n int) time.Duration {
+	wait := f.backoff
+	for i := 1; i < n && wait < f.maxBackoff; i++ {
+		wait *= 2
+	}
+	wait = min(wait, f.maxBackoff)
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"net"
+)
+
+// WithReusePort opens n UDP sockets per listen address with SO_REUSEPORT,
+// each with its own read loop, so the kernel spreads queries across them and
+// a single socket stops being the bottleneck on multi-core machines. Only
+// supported on Linux
+func WithReusePort(n int) Option {
+	return func(s *DNSServer) {
+		s.reusePort = n
+	}
+}
+
+// listenUDP opens the sockets for a single listen address: one plain socket,
+// or reusePort sockets sharing the address
+func (s *DNSServer) listenUDP(addr *net.UDPAddr) ([]*net.UDPConn, error) {
+	if s.reusePort <= 1 {
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	conns := make([]*net.UDPConn, 0, s.reusePort)
+	for i := 0; i < s.reusePort; i++ {
+		pc, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, pc.(*net.UDPConn))
+	}
+	return conns, nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// TestRoundTrip checks that random valid messages across every record type
+// survive Marshal, ParseMessage and Marshal again byte for byte
+func TestRoundTrip(t *testing.T) {
+	property := func(m randomMessage) bool {
+		if err := checkRoundTrip(m.Message); err != nil {
+			t.Logf("%v\n%s", err, m.Message)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// randomMessage is a Message testing/quick generates with newRandomMessage
+type randomMessage struct {
+	*Message
+}
+
+func (randomMessage) Generate(r *mathrand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(randomMessage{newRandomMessage(rand.New(rand.NewPCG(r.Uint64(), r.Uint64())))})
+}
+
+// checkRoundTrip marshals m, parses the result and marshals it again,
+// returning an error if parsing fails or the two encodings differ. Any
+// asymmetry between the encoder and the parser shows up here
+func checkRoundTrip(m *Message) error {
+	first, err := m.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshaling message: %w", err)
+	}
+	parsed, err := ParseMessage(first)
+	if err != nil {
+		return fmt.Errorf("parsing marshaled message: %w", err)
+	}
+	second, err := parsed.Marshal()
+	if err != nil {
+		return fmt.Errorf("re-marshaling message: %w", err)
+	}
+	if !bytes.Equal(first, second) {
+		return fmt.Errorf("re-marshaled message differs:\n%x\n%x", first, second)
+	}
+	return nil
+}
+
+// wireName encodes a name known to be valid, for building test RDATA
+func wireName(name string) []byte {
+	encoded, err := EncodeDomainName(name)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+// roundTripTypes are the record types newRandomMessage generates RDATA for, plus
+// one private-use type carried as opaque RDATA
+var roundTripTypes = []QuestionType{A, NS, CNAME, SOA, PTR, MX, TXT, AAAA, 65280}
+
+// newRandomMessage builds a random but valid Message covering every record
+// type the server models. Names are drawn from a small pool of related names
+// so compression is exercised
+func newRandomMessage(r *rand.Rand) *Message {
+	names := randomNames(r)
+	pick := func() string {
+		return names[r.IntN(len(names))]
+	}
+
+	flag := NewFlag([]byte{byte(r.UintN(256)), byte(r.UintN(256))})
+	m := &Message{
+		Header: &Header{ID: uint16(r.UintN(0x10000)), Flag: flag},
+	}
+
+	for range 1 + r.IntN(3) {
+		m.Questions = append(m.Questions, &Question{
+			Name:  pick(),
+			Type:  roundTripTypes[r.IntN(len(roundTripTypes))],
+			Class: 1,
+		})
+	}
+
+	sections := []*[]*ResourceRecord{&m.Answers, &m.Authorities, &m.Additionals}
+	for _, section := range sections {
+		for range r.IntN(5) {
+			rrType := roundTripTypes[r.IntN(len(roundTripTypes))]
+			*section = append(*section, &ResourceRecord{
+				Name:  pick(),
+				Type:  rrType,
+				Class: 1,
+				TTL:   r.Uint32(),
+				Data:  randomRData(r, rrType, pick),
+			})
+		}
+	}
+	return m
+}
+
+// randomNames returns a pool of names sharing suffixes, in mixed case
+func randomNames(r *rand.Rand) []string {
+	base := randomLabel(r) + "." + []string{"com", "org", "io", "ARPA"}[r.IntN(4)]
+	names := []string{base}
+	for range 1 + r.IntN(4) {
+		parent := names[r.IntN(len(names))]
+		names = append(names, randomLabel(r)+"."+parent)
+	}
+	return names
+}
+
+func randomLabel(r *rand.Rand) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-"
+	var b strings.Builder
+	for range 1 + r.IntN(12) {
+		b.WriteByte(alphabet[r.IntN(len(alphabet))])
+	}
+	return b.String()
+}
+
+// randomRData builds valid RDATA for rrType. Names inside RDATA are written
+// uncompressed, as the encoder never compresses them
+func randomRData(r *rand.Rand, rrType QuestionType, pick func() string) []byte {
+	switch rrType {
+	case A:
+		return net.IPv4(byte(r.UintN(256)), byte(r.UintN(256)), byte(r.UintN(256)), byte(r.UintN(256))).To4()
+	case AAAA:
+		ip := make([]byte, net.IPv6len)
+		for i := range ip {
+			ip[i] = byte(r.UintN(256))
+		}
+		return ip
+	case NS, CNAME, PTR:
+		return wireName(pick())
+	case MX:
+		return append(binary.BigEndian.AppendUint16(nil, uint16(r.UintN(0x10000))), wireName(pick())...)
+	case TXT:
+		var data []byte
+		for range 1 + r.IntN(3) {
+			s := randomLabel(r)
+			data = append(append(data, byte(len(s))), s...)
+		}
+		return data
+	case SOA:
+		data := append(wireName(pick()), wireName(pick())...)
+		for range 5 {
+			data = binary.BigEndian.AppendUint32(data, r.Uint32())
+		}
+		return data
+	default:
+		data := make([]byte, r.IntN(32))
+		for i := range data {
+			data[i] = byte(r.UintN(256))
+		}
+		return data
+	}
+}
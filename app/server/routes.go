@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Strategy is how queries for the names under a suffix are resolved, see
+// WithRoute
+type Strategy int
+
+const (
+	// StrategyForward sends queries to the upstream resolvers set with
+	// WithResolver
+	StrategyForward Strategy = iota
+	// StrategyRecurse resolves queries from the root servers, see
+	// WithRecursor
+	StrategyRecurse
+	// StrategyAuthoritative answers from the server's own data, the
+	// overrides, with AA set
+	StrategyAuthoritative
+	// StrategyBlock answers NXDOMAIN with an Extended DNS Error saying the
+	// name is blocked
+	StrategyBlock
+)
+
+func (st Strategy) String() string {
+	switch st {
+	case StrategyForward:
+		return "forward"
+	case StrategyRecurse:
+		return "recurse"
+	case StrategyAuthoritative:
+		return "authoritative"
+	case StrategyBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("Strategy(%d)", int(st))
+	}
+}
+
+// ParseStrategy returns the strategy called name: forward, recurse,
+// authoritative or block
+func ParseStrategy(name string) (Strategy, error) {
+	for _, st := range []Strategy{StrategyForward, StrategyRecurse, StrategyAuthoritative, StrategyBlock} {
+		if st.String() == name {
+			return st, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strategy %q", name)
+}
+
+// route resolves the names at or below suffix with strategy
+type route struct {
+	suffix   string
+	strategy Strategy
+}
+
+// WithRoute resolves queries for names at or below suffix with strategy, so
+// one server can be a stub, a recursive resolver and an authoritative server
+// for different namespaces. The deepest matching suffix wins and "." matches
+// every name. Queries matching no route, or with no question, go to the
+// server's handler as they would without routes. Queries are routed by their
+// first question
+func WithRoute(suffix string, strategy Strategy) Option {
+	return func(s *DNSServer) {
+		s.routes = append(s.routes, route{suffix: CanonicalName(suffix), strategy: strategy})
+	}
+}
+
+// WithHybrid makes the server both authoritative and recursive: names at or
+// below the zones set with WithZones are answered from its own data, the
+// overrides, with AA set, and every other name is resolved from the root
+// servers with RA set. Routes set with WithRoute take precedence for their
+// suffix, so a route for a zone opts it out of local authority, e.g. to
+// forward it instead, and a route for "." replaces recursion as the default
+func WithHybrid() Option {
+	return func(s *DNSServer) {
+		s.hybrid = true
+	}
+}
+
+// addHybridRoutes adds the routes WithHybrid implies to those configured: an
+// authoritative route for each zone and a recursive one for ".", unless a
+// route for the same suffix exists
+func (s *DNSServer) addHybridRoutes() {
+	routed := make(map[string]bool, len(s.routes))
+	for _, rt := range s.routes {
+		routed[rt.suffix] = true
+	}
+	add := func(suffix string, strategy Strategy) {
+		if !routed[suffix] {
+			routed[suffix] = true
+			s.routes = append(s.routes, route{suffix: suffix, strategy: strategy})
+		}
+	}
+	for _, zone := range s.zones {
+		add(zone, StrategyAuthoritative)
+	}
+	add("", StrategyRecurse)
+}
+
+// WithRecursor sets the Recursor resolving the routes using StrategyRecurse.
+// Without one a Recursor starting from the IANA root servers is used
+func WithRecursor(r *Recursor) Option {
+	return func(s *DNSServer) {
+		s.recursor = r
+	}
+}
+
+// buildChain wraps the handler queries go to, the router if routes are
+// configured, in the middleware. The TTL floors, the DNSSEC record filter,
+// the cache and then the rebinding filter go innermost, so the middleware sees
+// queries answered from the cache too, the cache only keeps filtered replies
+// with their DNSSEC records and each client's floor applies to cached replies
+// as well. uncached is the part of chain
+// below the cache, which warm names are looked up through
+func (s *DNSServer) buildChain() (chain, uncached Handler, err error) {
+	// Static answers are A records, which only hold an IPv4 address
+	if s.answerIP.To4() == nil {
+		return nil, nil, fmt.Errorf("dns: answer IP %s is not an IPv4 address", s.answerIP)
+	}
+
+	uncached = s.handler
+	if s.hybrid {
+		s.addHybridRoutes()
+	}
+	if len(s.routes) > 0 {
+		if err := s.checkRoutes(); err != nil {
+			return nil, nil, err
+		}
+		uncached = HandlerFunc(s.serveRouted)
+	}
+	if s.rebind != nil {
+		uncached = s.rebind(uncached)
+	}
+
+	middleware := append(s.middleware[:len(s.middleware):len(s.middleware)], s.ttlFloors...)
+	middleware = append(middleware, StripDNSSEC())
+	if s.cache != nil {
+		middleware = append(middleware, caching(s.cache, s.UnderMemoryPressure, s.background))
+	} else if len(s.warmNames) > 0 {
+		return nil, nil, fmt.Errorf("dns: warm names need a cache")
+	}
+	return Chain(uncached, middleware...), uncached, nil
+}
+
+// checkRoutes makes sure every strategy routed to can be served, creating
+// the default Recursor if one is needed
+func (s *DNSServer) checkRoutes() error {
+	for _, rt := range s.routes {
+		switch rt.strategy {
+		case StrategyForward:
+			if s.forwarder == nil {
+				return fmt.Errorf("dns: route %q forwards but no resolver is configured", rt.suffix)
+			}
+		case StrategyRecurse:
+			if s.recursor == nil {
+				s.recursor = NewRecursor()
+			}
+		case StrategyAuthoritative, StrategyBlock:
+		default:
+			return fmt.Errorf("dns: invalid strategy %s", rt.strategy)
+		}
+	}
+	return nil
+}
+
+// routeFor returns the route of the deepest suffix name falls under
+func (s *DNSServer) routeFor(name string) (route, bool) {
+	name = CanonicalName(name)
+	var best route
+	found := false
+	for _, rt := range s.routes {
+		if !isSubdomain(name, rt.suffix) {
+			continue
+		}
+		if !found || len(rt.suffix) > len(best.suffix) {
+			best, found = rt, true
+		}
+	}
+	return best, found
+}
+
+// serveRouted is the base of the handler chain when routes are configured,
+// handing each query to the strategy its first question is routed to
+func (s *DNSServer) serveRouted(w ResponseWriter, r *Message) {
+	if len(r.Questions) == 0 {
+		s.handler.ServeDNS(w, r)
+		return
+	}
+	rt, ok := s.routeFor(r.Questions[0].Name)
+	if !ok {
+		s.handler.ServeDNS(w, r)
+		return
+	}
+
+	switch rt.strategy {
+	case StrategyForward:
+		s.forwarder.ServeDNS(w, r)
+	case StrategyRecurse:
+		s.recursor.ServeDNS(w, r)
+	case StrategyAuthoritative:
+		s.serveAuthoritative(w, r, rt.suffix)
+	case StrategyBlock:
+		reply := NewReply(r)
+		reply.SetRCode(RCodeNXDomain)
+		reply.SetExtendedError(EDEBlocked, "blocked by policy")
+		s.writeMsg(w, reply)
+	}
+}
+
+// serveAuthoritative answers r with AA set from the data configured for
+// zone, the overrides. Names in the zone with no data of the queried type get
+// an empty NOERROR reply (NODATA) and names with no data at all NXDOMAIN. The
+// static answer IP is never used, as it is not data of the zone
+func (s *DNSServer) serveAuthoritative(w ResponseWriter, r *Message, zone string) {
+	reply := NewReply(r)
+
+	// Only standard queries are supported
+	if r.Header.Flag.GetOPCode() != QUERY {
+		reply.SetRCode(RCodeNotImp)
+		s.writeMsg(w, reply)
+		return
+	}
+
+	reply.Header.Flag.SetAA(true)
+	now := time.Now()
+	for _, question := range r.Questions {
+		if answers, ok := s.overrides.Lookup(question.Name, question.Type, now); ok {
+			for _, answer := range answers {
+				rr := *answer
+				rr.Name = question.Name
+				reply.Answers = append(reply.Answers, &rr)
+			}
+			continue
+		}
+		// The apex and names with data below them exist even without data of
+		// their own
+		if CanonicalName(question.Name) != zone && !s.overrides.exists(question.Name, now) {
+			reply.SetRCode(RCodeNXDomain)
+		}
+	}
+	s.writeMsg(w, reply)
+}
@@ -1,72 +1,451 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// dohCanaryDomain is the canary name browsers probe before enabling
+// DNS-over-HTTPS on their own
+const dohCanaryDomain = "use-application-dns.net"
+
 type DNSServer struct {
-	addr *net.UDPAddr
+	// addrs are the addresses served, each by its own UDP socket and read
+	// loop (or reusePort of them, see reuseport.go) and a TCP listener on
+	// the same port, see listener.go
+	addrs     []*net.UDPAddr
+	reusePort int
+
+	// TCP settings, see tcp.go
+	tcp            bool
+	tcpIdleTimeout time.Duration
+	stats          *QueryStats
+	answerIP       net.IP
+	// dohCanary answers the Firefox DoH canary domain with NXDOMAIN
+	dohCanary bool
+	overrides *Overrides
+	// Zone settings, see zones.go
+	zones              []string
+	refuseOutOfZone    []*net.UDPAddr
+	refuseOutOfZoneAll bool
+	handler            Handler
+	// Routing settings, see routes.go. forwarder is also set as handler by
+	// WithResolver
+	routes    []route
+	hybrid    bool
+	forwarder *Forwarder
+	recursor  *Recursor
+	// middleware wraps handler into chain when Listen starts, see
+	// middleware.go
+	middleware []Middleware
+	chain      Handler
+	// cache answers repeated queries inside the middleware, see cache.go,
+	// rebind filters what it stores and ttlFloors adjust what it serves, see
+	// rebind.go
+	cache     *Cache
+	rebind    Middleware
+	ttlFloors []Middleware
+	// warmNames are kept in the cache, see warm.go
+	warmNames []string
+
+	// Warm-up settings, see warmup.go
+	warmup           []WarmupStep
+	refuseUntilReady bool
+	ready            atomic.Bool
+
+	// Worker pool settings, see pool.go. With no workers every packet is
+	// handled in its own goroutine
+	workers    int
+	queueSize  int
+	overflow   OverflowPolicy
+	overflowed atomic.Uint64
+
+	// Load shedding settings, see loadshed.go
+	memoryLimit  uint64
+	shedFraction float64
+	pressure     atomic.Bool
+	shed         atomic.Uint64
+
+	// Shutdown state: mu guards listeners and done, which are only set while
+	// Listen is running. inflight counts packets being handled, and the
+	// background tasks they start, and is only waited on by Listen itself
+	mu         sync.Mutex
+	listeners  []listener
+	tcpConns   map[net.Conn]struct{}
+	tcpConnsWG sync.WaitGroup
+	done       chan struct{}
+	closing    atomic.Bool
+	inflight   sync.WaitGroup
+
+	// panics counts queries whose handling panicked, see panic.go
+	panics atomic.Uint64
+}
+
+// Option configures optional DNSServer behaviour
+type Option func(*DNSServer)
+
+// WithAnswerIP sets the static IPv4 address returned in A answers. Listen
+// fails if ip is not an IPv4 address
+func WithAnswerIP(ip net.IP) Option {
+	return func(s *DNSServer) {
+		s.answerIP = ip
+	}
+}
+
+// WithDoHCanary controls whether queries for use-application-dns.net are
+// answered with NXDOMAIN, which tells browsers to disable their built-in DoH
+// and keep using this server. Enabled by default
+func WithDoHCanary(enabled bool) Option {
+	return func(s *DNSServer) {
+		s.dohCanary = enabled
+	}
 }
 
-func NewDnsServer(addr *net.UDPAddr) *DNSServer {
-	return &DNSServer{
-		addr,
+// WithAddrs adds more addresses to listen on alongside the one given to
+// NewDnsServer, e.g. [::]:2053 next to 0.0.0.0:2053 for dual-stack hosts
+func WithAddrs(addrs ...*net.UDPAddr) Option {
+	return func(s *DNSServer) {
+		s.addrs = append(s.addrs, addrs...)
 	}
 }
 
+func NewDnsServer(addr *net.UDPAddr, opts ...Option) *DNSServer {
+	s := &DNSServer{
+		addrs:     []*net.UDPAddr{addr},
+		stats:     NewQueryStats(),
+		answerIP:  net.IPv4(8, 8, 8, 8),
+		dohCanary: true,
+		overrides: NewOverrides(),
+
+		tcp:            true,
+		tcpIdleTimeout: defaultTCPIdleTimeout,
+	}
+	s.handler = HandlerFunc(s.serveStatic)
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Stats returns the per-type query counters collected by the server
+func (s *DNSServer) Stats() *QueryStats {
+	return s.stats
+}
+
 func (s *DNSServer) String() string {
-	return fmt.Sprintf("%s:%d", s.addr.IP, s.addr.Port)
+	addrs := make([]string, len(s.addrs))
+	for i, addr := range s.addrs {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, ", ")
 }
 
-func (s *DNSServer) Listen() error {
-	conn, err := net.ListenUDP("udp", s.addr)
+// Listen serves queries on every configured address until ctx is cancelled,
+// Shutdown is called or a socket fails. On shutdown it stops reading, waits
+// for in-flight queries to be answered and returns nil
+func (s *DNSServer) Listen(ctx context.Context) error {
+	chain, uncached, err := s.buildChain()
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-
-	buf := make([]byte, 512)
 
-	for {
-		size, source, err := conn.ReadFromUDP(buf)
+	var listeners []listener
+	for _, addr := range s.addrs {
+		addrListeners, err := s.listen(addr)
 		if err != nil {
+			closeListeners(listeners)
 			return err
 		}
+		listeners = append(listeners, addrListeners...)
+	}
+	defer closeListeners(listeners)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	s.mu.Lock()
+	s.listeners = listeners
+	s.done = done
+	s.mu.Unlock()
 
-		request := ParseRequest(buf[:size])
+	// Shutdown may have been requested before the sockets existed
+	if s.closing.Load() {
+		return nil
+	}
+	stop := context.AfterFunc(ctx, s.stopReading)
+	defer stop()
+
+	warmupCtx, cancelWarmup := context.WithCancel(ctx)
+	defer cancelWarmup()
+	defer s.ready.Store(false)
+	go s.runWarmup(warmupCtx)
+
+	s.chain = chain
+
+	if s.memoryLimit > 0 {
+		go s.monitorMemory(done)
+	}
+
+	var queue chan packetJob
+	if s.workers > 0 {
+		queue = s.startWorkers()
+		defer close(queue)
+	}
+	// Runs before the queue and sockets are closed so in-flight handlers can
+	// still write their replies
+	defer s.inflight.Wait()
+	defer s.tcpConnsWG.Wait()
 
-		receivedData := string(buf[:size])
-		fmt.Printf("Received %d bytes from %s: %s\n", size, source, receivedData)
+	// Warm names are refreshed until Listen returns
+	warmCtx, stopWarm := context.WithCancel(ctx)
+	defer stopWarm()
+	s.startWarm(warmCtx, uncached)
 
-		question := &Question{
-			Name:  "codecrafters.io",
-			Type:  A,
-			Class: 1,
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			errs <- l.serve(queue)
+		}()
+	}
+
+	// A failing socket takes the others down with it
+	var firstErr error
+	for range cap(errs) {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			s.stopReading()
 		}
-		fmt.Printf("Question: %v\n", question)
-
-		header := Header{
-			ID:      request.Header.ID,
-			Flag:    NewFlag([]byte{0x00, 0x00}),
-			QDCount: request.Header.QDCount,
-			ANCount: request.Header.ANCount,
-			NSCount: request.Header.NSCount,
-			ARCount: request.Header.ARCount,
+	}
+	return firstErr
+}
+
+// Shutdown stops the server from accepting new queries and waits for
+// in-flight ones to be answered. If ctx expires first the sockets are closed
+// immediately and ctx's error is returned
+func (s *DNSServer) Shutdown(ctx context.Context) error {
+	s.stopReading()
+
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		closeListeners(s.listeners)
+		for conn := range s.tcpConns {
+			conn.Close()
 		}
-		header.Flag.SetQR(true)
-		fmt.Printf("Header: %v\n", header)
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
 
-		// Create an empty response
-		response := make([]byte, 512)
-		responseHeader := header.Marshal()
-		questionBytes := question.Marshal()
-		copy(response[12:], questionBytes)
-		copy(response[:12], responseHeader)
+// stopReading marks the server as closing and unblocks the read loops. TCP
+// listeners are closed but the UDP sockets and open TCP connections are left
+// open so pending replies can still be written
+func (s *DNSServer) stopReading() {
+	s.closing.Store(true)
 
-		_, err = conn.WriteToUDP(response, source)
-		if err != nil {
-			return err
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.listeners {
+		l.stopReading()
+	}
+	for conn := range s.tcpConns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// handlePacket parses a single query and hands it to the handler chain,
+// which replies through w. Failures before the handler runs are answered
+// directly
+func (s *DNSServer) handlePacket(w ResponseWriter, packet []byte) {
+	defer s.recoverPacket(w.RemoteAddr())
+
+	request, err := ParseMessage(packet)
+	if err != nil {
+		fmt.Printf("Failed to parse message from %s: %v\n", w.RemoteAddr(), err)
+		// Without a header there is no ID to answer to, so just drop it
+		if request == nil {
+			return
 		}
+		s.writeMsg(w, newErrorReply(request, RCodeFormErr))
+		return
+	}
+	for _, q := range request.Questions {
+		s.stats.Record(q.Type)
+	}
+
+	// UDP replies may be as large as the client's advertised EDNS payload size
+	if uw, ok := w.(*udpResponseWriter); ok {
+		uw.maxSize = min(request.UDPSize(), ednsUDPSize)
+	}
+
+	// Queries using a later EDNS version than the server implements get
+	// BADVERS, with an OPT record carrying the version it does support
+	// (RFC 6891 §6.1.3)
+	if opt := request.OPT(); opt != nil && optVersion(opt) > ednsVersion {
+		s.writeMsg(w, newErrorReply(request, RCodeBadVers))
+		return
+	}
+
+	if s.refuseUntilReady && !s.ready.Load() {
+		s.writeMsg(w, newErrorReply(request, RCodeRefused))
+		return
+	}
+
+	if s.shouldShed(request) {
+		s.shed.Add(1)
+		fmt.Printf("Shedding low-priority query %d from %s under memory pressure\n", request.Header.ID, w.RemoteAddr())
+		return
+	}
+
+	s.chain.ServeDNS(w, request)
+}
+
+// dispatch hands a received packet to the worker pool queue or, without one,
+// to its own goroutine. done, if not nil, is called once the packet has been
+// handled or dropped
+func (s *DNSServer) dispatch(queue chan packetJob, w ResponseWriter, packet []byte, done func()) {
+	s.inflight.Add(1)
+	finish := func() {
+		if done != nil {
+			done()
+		}
+		s.inflight.Done()
+	}
+
+	if queue != nil {
+		if !s.enqueue(queue, packetJob{w: w, packet: packet, done: finish}) {
+			finish()
+		}
+		return
+	}
+	go func() {
+		defer finish()
+		s.handlePacket(w, packet)
+	}()
+}
+
+// serveStatic is the default Handler. It answers A queries with the
+// configured static address, applying overrides, the DoH canary and the
+// zones the server is authoritative for, if any
+func (s *DNSServer) serveStatic(w ResponseWriter, request *Message) {
+	reply := NewReply(request)
+
+	// Only standard queries are supported
+	if request.Header.Flag.GetOPCode() != QUERY {
+		reply.SetRCode(RCodeNotImp)
+		s.writeMsg(w, reply)
+		return
+	}
+
+	now := time.Now()
+	outOfZone := false
+	for _, question := range request.Questions {
+		// Overrides take precedence over any other data
+		if answers, ok := s.overrides.Lookup(question.Name, question.Type, now); ok {
+			for _, answer := range answers {
+				rr := *answer
+				rr.Name = question.Name
+				reply.Answers = append(reply.Answers, &rr)
+			}
+			continue
+		}
+		if s.dohCanary && CanonicalName(question.Name) == dohCanaryDomain {
+			reply.SetRCode(RCodeNXDomain)
+			continue
+		}
+		if !s.inZone(question.Name) {
+			outOfZone = true
+			continue
+		}
+		if len(s.zones) > 0 {
+			reply.Header.Flag.SetAA(true)
+		}
+		if question.Type == A && question.Class == 1 {
+			reply.Answers = append(reply.Answers, NewARecord(question.Name, s.answerIP, 60))
+		}
+	}
+
+	if outOfZone && s.refusesOutOfZone(w.LocalAddr()) {
+		reply.Answers = nil
+		reply.Header.Flag.SetAA(false)
+		reply.SetRCode(RCodeRefused)
+	}
+	s.writeMsg(w, reply)
+}
+
+// writeMsg sends reply through w, logging rather than returning failures
+func (s *DNSServer) writeMsg(w ResponseWriter, reply *Message) {
+	if err := w.WriteMsg(reply); err != nil {
+		fmt.Printf("Failed to reply to %s: %v\n", w.RemoteAddr(), err)
+	}
+}
+
+// maxUDPSize is the largest UDP reply a client without EDNS accepts
+// (RFC 1035 §4.2.1)
+const maxUDPSize = 512
+
+// writeUDP marshals reply, truncating it to maxSize bytes, and sends it to
+// the client
+func writeUDP(conn *net.UDPConn, source *net.UDPAddr, reply *Message, maxSize int) error {
+	// Only the bytes actually marshaled are sent, never a padded buffer
+	response, truncated := marshalReply(reply, maxSize)
+	if truncated {
+		fmt.Printf("Truncated reply to %s at %d bytes\n", source, len(response))
+	}
+
+	if debugBuild {
+		if err := VerifyCompression(response); err != nil {
+			fmt.Println("Compression check failed:", err)
+		}
+	}
+
+	response, deliver := injectFault("reply", response)
+	if !deliver {
+		return nil
+	}
+
+	_, err := conn.WriteToUDP(response, source)
+	return err
+}
+
+// marshalReply marshals reply like MarshalTruncated, falling back to an empty
+// SERVFAIL if one of its names cannot be encoded
+func marshalReply(reply *Message, maxSize int) ([]byte, bool) {
+	response, truncated, err := reply.MarshalTruncated(maxSize)
+	if err != nil {
+		fmt.Println("Failed to encode reply:", err)
+		response, truncated, _ = newErrorReply(reply, RCodeServFail).MarshalTruncated(maxSize)
+	}
+	return response, truncated
+}
+
+// newErrorReply builds an empty response to request carrying the given rcode
+func newErrorReply(request *Message, rcode RCode) *Message {
+	header := &Header{
+		ID:   request.Header.ID,
+		Flag: NewFlag([]byte{0x00, 0x00}),
+	}
+	header.Flag.SetQR(true)
+	header.Flag.SetRD(request.Header.Flag.GetRD())
+
+	reply := &Message{Header: header}
+	if request.OPT() != nil {
+		reply.Additionals = []*ResourceRecord{NewOPT(ednsUDPSize)}
 	}
+	reply.SetRCode(rcode)
+	return reply
 }
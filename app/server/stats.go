@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryStats counts received queries per question type, including numeric
+// types the server has no name for, so that surging new types (e.g. type 65)
+// show up and can guide which record types to support next. When the Metrics
+// middleware is installed it also counts replies per rcode and their latency,
+// and per client and name over a sliding window for the top talkers report
+type QueryStats struct {
+	mu        sync.Mutex
+	byType    map[QuestionType]uint64
+	byRCode   map[RCode]uint64
+	responses uint64
+	latency   time.Duration
+	top       topTalkers
+}
+
+func NewQueryStats() *QueryStats {
+	return &QueryStats{
+		byType:  make(map[QuestionType]uint64),
+		byRCode: make(map[RCode]uint64),
+	}
+}
+
+// Record counts a single query of the given type. The first time a type the
+// server does not know about is seen it is logged
+func (s *QueryStats) Record(qt QuestionType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, seen := s.byType[qt]; !seen && !qt.Known() {
+		fmt.Printf("First query seen for unknown type %s\n", qt)
+	}
+	s.byType[qt]++
+}
+
+// ByType returns a copy of the per-type query counters
+func (s *QueryStats) ByType() map[QuestionType]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[QuestionType]uint64, len(s.byType))
+	for qt, n := range s.byType {
+		counts[qt] = n
+	}
+	return counts
+}
+
+// Unknown returns the counters for types the server has no name for
+func (s *QueryStats) Unknown() map[QuestionType]uint64 {
+	counts := s.ByType()
+	for qt := range counts {
+		if qt.Known() {
+			delete(counts, qt)
+		}
+	}
+	return counts
+}
+
+// TypeReport lists how many queries were received for each question type
+// since the server started, busiest first. Unknown repeats the types the
+// server has no name for, which are also counted in Types
+type TypeReport struct {
+	Types   []TopEntry `json:"types"`
+	Unknown []TopEntry `json:"unknown"`
+}
+
+func (r TypeReport) String() string {
+	var b strings.Builder
+	b.WriteString("Queries by type:\n")
+	if len(r.Types) == 0 {
+		b.WriteString("  (none)\n")
+	}
+	for _, e := range r.Types {
+		fmt.Fprintf(&b, "  %8d  %s\n", e.Count, e.Key)
+	}
+	if len(r.Unknown) > 0 {
+		b.WriteString("\nUnknown types:\n")
+		for _, e := range r.Unknown {
+			fmt.Fprintf(&b, "  %8d  %s\n", e.Count, e.Key)
+		}
+	}
+	return b.String()
+}
+
+// Types returns the per-type query counters as a report
+func (s *QueryStats) Types() TypeReport {
+	return TypeReport{
+		Types:   typeEntries(s.ByType()),
+		Unknown: typeEntries(s.Unknown()),
+	}
+}
+
+// typeEntries turns per-type counters into report entries, busiest first
+func typeEntries(counts map[QuestionType]uint64) []TopEntry {
+	named := make(map[string]uint64, len(counts))
+	for qt, n := range counts {
+		named[qt.String()] = n
+	}
+	return topEntries(named, len(named))
+}
+
+// RecordResponse counts a reply with the given rcode that took d to produce
+func (s *QueryStats) RecordResponse(rcode RCode, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.byRCode[rcode]++
+	s.responses++
+	s.latency += d
+}
+
+// ByRCode returns a copy of the per-rcode reply counters
+func (s *QueryStats) ByRCode() map[RCode]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[RCode]uint64, len(s.byRCode))
+	for rcode, n := range s.byRCode {
+		counts[rcode] = n
+	}
+	return counts
+}
+
+// MeanLatency returns the average time taken to produce a reply
+func (s *QueryStats) MeanLatency() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.responses == 0 {
+		return 0
+	}
+	return s.latency / time.Duration(s.responses)
+}
+
+// RecordTalker counts a reply with rcode to client for name in the top talkers
+// window. blocked marks replies refusing the name by policy
+func (s *QueryStats) RecordTalker(client, name string, rcode RCode, blocked bool) {
+	s.top.record(time.Now(), client, name, rcode, blocked)
+}
+
+// Top returns the n busiest clients and names of each kind over the last
+// few minutes
+func (s *QueryStats) Top(n int) TopReport {
+	return s.top.report(time.Now(), n)
+}
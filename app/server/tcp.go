@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultTCPIdleTimeout is how long an idle TCP connection is kept open
+// waiting for another query. RFC 7766 §6.2.3 recommends seconds rather than
+// minutes
+const defaultTCPIdleTimeout = 10 * time.Second
+
+const (
+	// maxTCPSize is the largest message the 2 byte length prefix can frame
+	maxTCPSize = 0xFFFF
+
+	// Replies are written in chunks of tcpWriteChunk bytes, each of which
+	// must be accepted within tcpWriteTimeout. A slow client still receives a
+	// large reply while a stalled one cannot hold the connection forever
+	tcpWriteChunk   = 16 * 1024
+	tcpWriteTimeout = 5 * time.Second
+)
+
+// WithTCP sets whether DNS over TCP (RFC 7766) is served alongside UDP on
+// every listen address, as it is by default
+func WithTCP(enabled bool) Option {
+	return func(s *DNSServer) {
+		s.tcp = enabled
+	}
+}
+
+// WithTCPIdleTimeout sets how long a TCP connection may sit idle between
+// queries before the server closes it
+func WithTCPIdleTimeout(d time.Duration) Option {
+	return func(s *DNSServer) {
+		s.tcpIdleTimeout = d
+	}
+}
+
+// serveTCPConn reads length-prefixed queries from conn until the client
+// closes it, it sits idle too long or the server shuts down. Queries are
+// handled concurrently and may be answered out of order (RFC 7766 §6.2.1.1);
+// the connection is closed once every one has been answered
+func (s *DNSServer) serveTCPConn(conn net.Conn, queue chan packetJob) {
+	defer s.tcpConnsWG.Done()
+
+	var pending sync.WaitGroup
+	defer func() {
+		pending.Wait()
+		s.untrackTCPConn(conn)
+		conn.Close()
+	}()
+
+	w := &tcpResponseWriter{conn: conn}
+	for s.armTCPRead(conn) {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+
+		pending.Add(1)
+		s.dispatch(queue, w, packet, pending.Done)
+	}
+}
+
+// armTCPRead sets the idle deadline for the next query on conn, or returns
+// false if the server is closing. It holds s.mu like stopReading, so it can
+// never push back the deadline stopReading set to interrupt the read
+func (s *DNSServer) armTCPRead(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing.Load() {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(s.tcpIdleTimeout))
+	return true
+}
+
+// trackTCPConn registers an open connection so shutdown can stop it reading.
+// Returns false if the server is already closing
+func (s *DNSServer) trackTCPConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing.Load() {
+		return false
+	}
+	if s.tcpConns == nil {
+		s.tcpConns = make(map[net.Conn]struct{})
+	}
+	s.tcpConns[conn] = struct{}{}
+	return true
+}
+
+func (s *DNSServer) untrackTCPConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tcpConns, conn)
+}
+
+// tcpResponseWriter replies to a query received on a TCP connection. Several
+// queries on one connection may be answered concurrently, so writes are
+// serialised and one reply's chunks are never interleaved with another's
+type tcpResponseWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (w *tcpResponseWriter) WriteMsg(m *Message) error {
+	// Replies too large even for TCP are cut like UDP ones, with TC set
+	response, truncated := marshalReply(m, maxTCPSize)
+	if truncated {
+		fmt.Printf("Truncated reply to %s at %d bytes\n", w.conn.RemoteAddr(), len(response))
+	}
+
+	if debugBuild {
+		if err := VerifyCompression(response); err != nil {
+			fmt.Println("Compression check failed:", err)
+		}
+	}
+
+	buf := make([]byte, 2, 2+len(response))
+	binary.BigEndian.PutUint16(buf, uint16(len(response)))
+	buf = append(buf, response...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.conn.SetWriteDeadline(time.Time{})
+	for len(buf) > 0 {
+		chunk := buf[:min(len(buf), tcpWriteChunk)]
+		w.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+		n, err := w.conn.Write(chunk)
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func (w *tcpResponseWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+func (w *tcpResponseWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+func (w *tcpResponseWriter) Network() string {
+	return "tcp"
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPServer starts a server on a free loopback port and returns it, the
+// address of its TCP listener and the channel Listen returns on. The TCP
+// listener reuses the UDP port, which may already be taken for TCP, so that
+// case is retried on another port
+func startTCPServer(t *testing.T, opts ...Option) (*DNSServer, string, chan error) {
+	for range 5 {
+		s := NewDnsServer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, opts...)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- s.Listen(context.Background())
+		}()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			select {
+			case err := <-errs:
+				t.Logf("Listen: %v", err)
+				deadline = time.Time{}
+				continue
+			default:
+			}
+			s.mu.Lock()
+			for _, l := range s.listeners {
+				if tl, ok := l.(*tcpListener); ok {
+					s.mu.Unlock()
+					return s, tl.l.Addr().String(), errs
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+	t.Fatal("server did not start listening")
+	return nil, "", nil
+}
+
+func TestShutdownWithIdleTCPClient(t *testing.T) {
+	tests := []struct {
+		name string
+		// readReply waits for the reply before shutting down, leaving the
+		// connection idle. Otherwise shutdown races the connection re-arming
+		// its idle deadline after the query
+		readReply bool
+	}{
+		{"idle", true},
+		{"right after a query", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for range 10 {
+				s, addr, errs := startTCPServer(t, WithTCPIdleTimeout(time.Minute))
+
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				packet, err := NewQuery(1, "example.com", A, false).Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...)); err != nil {
+					t.Fatal(err)
+				}
+				if tt.readReply {
+					var length [2]byte
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint16(length[:]))); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				err = s.Shutdown(ctx)
+				cancel()
+				if err != nil {
+					t.Fatalf("Shutdown: %v", err)
+				}
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+
+				// The server has closed its end rather than waiting out the
+				// idle timeout
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := io.ReadAll(conn); err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						t.Fatal("connection left open after shutdown")
+					}
+				}
+			}
+		})
+	}
+}
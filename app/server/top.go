@@ -0,0 +1,196 @@
+package server
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// topWindow is how far back the top talkers report looks
+	topWindow = 5 * time.Minute
+
+	// topBuckets is how many slices the window is kept in. The oldest slice is
+	// dropped whole, so the window slides in steps of topWindow/topBuckets
+	topBuckets = 30
+
+	// maxTopKeys bounds the distinct clients or names counted per slice, so a
+	// flood of random names cannot grow the counters without limit. Names past
+	// it are counted under topOther
+	maxTopKeys = 10000
+
+	// topOther is the key everything past maxTopKeys is counted under
+	topOther = "(other)"
+)
+
+// topTalkers counts replies per client and per name over a sliding window,
+// for the top talkers report
+type topTalkers struct {
+	mu      sync.Mutex
+	buckets [topBuckets]topBucket
+}
+
+// topBucket holds the counters of one slice of the window
+type topBucket struct {
+	start    time.Time
+	clients  map[string]uint64
+	domains  map[string]uint64
+	blocked  map[string]uint64
+	nxdomain map[string]uint64
+}
+
+// TopEntry is a client or name and how many replies it got
+type TopEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// TopReport lists the busiest clients and names over the last Window. Blocked
+// names are those answered with the Blocked Extended DNS Error, whether or not
+// the client could receive it; NXDOMAIN sources are the clients that got
+// NXDOMAIN
+type TopReport struct {
+	Window   time.Duration `json:"window"`
+	Clients  []TopEntry    `json:"clients"`
+	Domains  []TopEntry    `json:"domains"`
+	Blocked  []TopEntry    `json:"blocked"`
+	NXDomain []TopEntry    `json:"nxdomain"`
+}
+
+func (r TopReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Top talkers over the last %s\n", r.Window)
+	for _, section := range []struct {
+		title   string
+		entries []TopEntry
+	}{
+		{"Clients", r.Clients},
+		{"Domains", r.Domains},
+		{"Blocked domains", r.Blocked},
+		{"NXDOMAIN sources", r.NXDomain},
+	} {
+		fmt.Fprintf(&b, "\n%s:\n", section.title)
+		if len(section.entries) == 0 {
+			b.WriteString("  (none)\n")
+		}
+		for _, e := range section.entries {
+			fmt.Fprintf(&b, "  %8d  %s\n", e.Count, e.Key)
+		}
+	}
+	return b.String()
+}
+
+// record counts a reply with rcode to client for name at now
+func (t *topTalkers) record(now time.Time, client, name string, rcode RCode, blocked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucket(now)
+	countKey(b.clients, client)
+	if name != "" {
+		countKey(b.domains, name)
+		if blocked {
+			countKey(b.blocked, name)
+		}
+	}
+	if rcode == RCodeNXDomain {
+		countKey(b.nxdomain, client)
+	}
+}
+
+// bucket returns the bucket counting now, clearing it first if it still holds
+// a slice that has left the window
+func (t *topTalkers) bucket(now time.Time) *topBucket {
+	step := topWindow / topBuckets
+	start := now.Truncate(step)
+	b := &t.buckets[start.UnixNano()/int64(step)%topBuckets]
+	if !b.start.Equal(start) {
+		*b = topBucket{
+			start:    start,
+			clients:  make(map[string]uint64),
+			domains:  make(map[string]uint64),
+			blocked:  make(map[string]uint64),
+			nxdomain: make(map[string]uint64),
+		}
+	}
+	return b
+}
+
+// countKey adds one to the counter of key, or of topOther if counters is full
+func countKey(counters map[string]uint64, key string) {
+	if _, ok := counters[key]; !ok && len(counters) >= maxTopKeys {
+		key = topOther
+	}
+	counters[key]++
+}
+
+// report sums the buckets still inside the window at now and returns the n
+// largest counters of each kind
+func (t *topTalkers) report(now time.Time, n int) TopReport {
+	clients := make(map[string]uint64)
+	domains := make(map[string]uint64)
+	blocked := make(map[string]uint64)
+	nxdomain := make(map[string]uint64)
+
+	t.mu.Lock()
+	oldest := now.Add(-topWindow)
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if b.start.IsZero() || !b.start.After(oldest) {
+			continue
+		}
+		for _, sum := range []struct{ into, from map[string]uint64 }{
+			{clients, b.clients}, {domains, b.domains}, {blocked, b.blocked}, {nxdomain, b.nxdomain},
+		} {
+			for key, count := range sum.from {
+				sum.into[key] += count
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	return TopReport{
+		Window:   topWindow,
+		Clients:  topEntries(clients, n),
+		Domains:  topEntries(domains, n),
+		Blocked:  topEntries(blocked, n),
+		NXDomain: topEntries(nxdomain, n),
+	}
+}
+
+// topEntries returns the n largest counters, ties broken by key
+func topEntries(counters map[string]uint64, n int) []TopEntry {
+	entries := make([]TopEntry, 0, len(counters))
+	for key, count := range counters {
+		entries = append(entries, TopEntry{Key: key, Count: count})
+	}
+	slices.SortFunc(entries, func(a, b TopEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	return entries[:min(n, len(entries))]
+}
+
+// blockedReply reports whether m was given the Blocked Extended DNS Error,
+// here or by an upstream
+func blockedReply(m *Message) bool {
+	if m.extendedError == EDEBlocked {
+		return true
+	}
+	opt := m.OPT()
+	if opt == nil {
+		return false
+	}
+	for _, ede := range optOptions(opt, ednsOptionEDE) {
+		if len(ede) >= 2 && binary.BigEndian.Uint16(ede) == EDEBlocked {
+			return true
+		}
+	}
+	return false
+}
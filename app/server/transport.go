@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// transport carries queries to a single upstream
+type transport interface {
+	// exchange sends query and returns the upstream's reply to it
+	exchange(ctx context.Context, query *Message) (*Message, error)
+}
+
+// newTransport builds the transport for an upstream spec, which is either a
+// plain host:port (port 53 if omitted) queried over UDP with TCP fallback, or
+// a tls:// URL for DNS over TLS, an https:// URL for DNS over HTTPS or a
+// quic:// URL for DNS over QUIC, see newDoTTransport, newDoHTransport and
+// newDoQTransport. Connections are opened through pool
+func newTransport(spec string, pool *ConnPool) (transport, error) {
+	if !strings.Contains(spec, "://") {
+		return plainTransport{addr: withDefaultPort(spec, "53"), pool: pool}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("dns: invalid upstream %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "udp":
+		return plainTransport{addr: withDefaultPort(u.Host, "53"), pool: pool}, nil
+	case "tls":
+		return newDoTTransport(u, pool)
+	case "https":
+		return newDoHTransport(u, pool), nil
+	case "quic":
+		return newDoQTransport(u, pool)
+	default:
+		return nil, fmt.Errorf("dns: unsupported upstream scheme %q", u.Scheme)
+	}
+}
+
+// withDefaultPort appends port to addr if it does not name one
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// plainTransport queries an upstream over UDP, retrying over TCP when the
+// reply is truncated. Every UDP query uses a socket of its own, so a fresh
+// random source port, see antispoof.go, while TCP connections are pooled
+type plainTransport struct {
+	addr string
+	pool *ConnPool
+}
+
+func (t plainTransport) exchange(ctx context.Context, query *Message) (*Message, error) {
+	conn, err := t.pool.dial(ctx, func(ctx context.Context) (net.Conn, error) {
+		return dialUDP(ctx, t.addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := exchangeConn(ctx, conn, false, query)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := ParseMessage(raw)
+	if err != nil || !reply.Header.Flag.GetTC() {
+		return reply, err
+	}
+
+	if raw, err = t.pool.exchange(ctx, "tcp://"+t.addr, dialer("tcp", t.addr), query); err != nil {
+		return nil, err
+	}
+	return ParseMessage(raw)
+}
+
+// dialer returns a dialFunc connecting to addr over network
+func dialer(network, addr string) dialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// upstreamAttemptTimeout bounds a single query to one upstream unless set
+	// by WithAttemptTimeout, so a dead primary still leaves time to fail over
+	// to the next one
+	upstreamAttemptTimeout = time.Second
+
+	// Backoff bounds for upstreams marked down: the window doubles with each
+	// consecutive failure, up to the maximum
+	upstreamMinBackoff = 5 * time.Second
+	upstreamMaxBackoff = time.Minute
+
+	// upstreamExploreRate is the fraction of queries sent to a random healthy
+	// upstream rather than the fastest, so RTTs of the others stay current
+	upstreamExploreRate = 0.05
+)
+
+// upstream is a resolver queries are forwarded to, along with its health and
+// latency. An upstream that times out or answers SERVFAIL is marked down and
+// only probed again once its backoff window has passed
+type upstream struct {
+	addr      string
+	transport transport
+
+	mu       sync.Mutex
+	rtt      time.Duration // Smoothed round-trip time, 0 until measured
+	down     bool
+	failures int       // Consecutive failures
+	retryAt  time.Time // When the next health probe is due while down
+	probing  bool
+}
+
+func (u *upstream) String() string {
+	return u.addr
+}
+
+// healthy reports whether queries should be sent to u
+func (u *upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.down
+}
+
+// observe folds a measured round-trip time into the smoothed RTT, an EWMA
+// weighting each new sample by 1/8 as TCP does (RFC 6298)
+func (u *upstream) observe(d time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.rtt == 0 {
+		u.rtt = d
+		return
+	}
+	u.rtt += (d - u.rtt) / 8
+}
+
+// smoothedRTT returns the smoothed round-trip time, 0 if never measured
+func (u *upstream) smoothedRTT() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.rtt
+}
+
+// markDown records a failure, taking u out of rotation until the backoff
+// window has passed
+func (u *upstream) markDown(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures++
+	backoff := min(upstreamMinBackoff<<min(u.failures-1, 16), upstreamMaxBackoff)
+	u.retryAt = time.Now().Add(backoff)
+	if !u.down {
+		fmt.Printf("Upstream %s marked down for %s: %v\n", u.addr, backoff, err)
+	}
+	u.down = true
+}
+
+// markUp records a successful query, putting u back into rotation
+func (u *upstream) markUp() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.down {
+		fmt.Printf("Upstream %s is back up\n", u.addr)
+	}
+	u.down = false
+	u.failures = 0
+}
+
+// claimProbe reports whether u is down with its backoff window passed and no
+// probe running yet. The caller must then probe it and call probeDone
+func (u *upstream) claimProbe(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.down || u.probing || now.Before(u.retryAt) {
+		return false
+	}
+	u.probing = true
+	return true
+}
+
+func (u *upstream) probeDone() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.probing = false
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// VerifyCompression decodes a marshaled message and checks that every
+// compression pointer (RFC 1035 §4.1.4) in it targets the start of a label
+// that was already written earlier in the message. It is meant to catch
+// encoder bugs in our own responses before they reach the wire.
+// Names inside RDATA are not checked since the encoder never compresses them
+func VerifyCompression(buf []byte) error {
+	if len(buf) < 12 {
+		return fmt.Errorf("message too short for header: %d bytes", len(buf))
+	}
+	qdcount := int(binary.BigEndian.Uint16(buf[4:6]))
+	rrcount := int(binary.BigEndian.Uint16(buf[6:8])) +
+		int(binary.BigEndian.Uint16(buf[8:10])) +
+		int(binary.BigEndian.Uint16(buf[10:12]))
+
+	// Offsets of every label start seen so far; a pointer may target any of
+	// them since it can refer to a suffix of an earlier name
+	labelStarts := make(map[int]bool)
+	offset := 12
+
+	for i := 0; i < qdcount; i++ {
+		newOffset, err := verifyName(buf, offset, labelStarts)
+		if err != nil {
+			return fmt.Errorf("question %d: %w", i, err)
+		}
+		// Skip type and class
+		offset = newOffset + 4
+		if offset > len(buf) {
+			return fmt.Errorf("question %d: truncated type/class at offset %d", i, newOffset)
+		}
+	}
+
+	for i := 0; i < rrcount; i++ {
+		newOffset, err := verifyName(buf, offset, labelStarts)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", i, err)
+		}
+		// Skip type, class and TTL, then the RDATA using RDLENGTH
+		if newOffset+10 > len(buf) {
+			return fmt.Errorf("record %d: truncated fixed fields at offset %d", i, newOffset)
+		}
+		rdLength := int(binary.BigEndian.Uint16(buf[newOffset+8 : newOffset+10]))
+		offset = newOffset + 10 + rdLength
+		if offset > len(buf) {
+			return fmt.Errorf("record %d: truncated rdata at offset %d", i, newOffset+10)
+		}
+	}
+	return nil
+}
+
+// verifyName walks a single name starting at offset, recording its label
+// starts and validating a terminating pointer if present. Returns the offset
+// just after the name
+func verifyName(buf []byte, offset int, labelStarts map[int]bool) (int, error) {
+	for {
+		if offset >= len(buf) {
+			return 0, fmt.Errorf("name runs past end of message at offset %d", offset)
+		}
+		labelLength := int(buf[offset])
+
+		switch {
+		case labelLength == 0:
+			return offset + 1, nil
+		case labelLength >= 192:
+			if offset+1 >= len(buf) {
+				return 0, fmt.Errorf("truncated pointer at offset %d", offset)
+			}
+			target := int(binary.BigEndian.Uint16(buf[offset:offset+2]) & 0x3FFF)
+			if target >= offset {
+				return 0, fmt.Errorf("pointer at offset %d targets later offset %d", offset, target)
+			}
+			if !labelStarts[target] {
+				return 0, fmt.Errorf("pointer at offset %d targets offset %d which is not a label start", offset, target)
+			}
+			return offset + 2, nil
+		case labelLength > 63:
+			return 0, fmt.Errorf("invalid label length %d at offset %d", labelLength, offset)
+		}
+
+		labelStarts[offset] = true
+		offset += 1 + labelLength
+	}
+}
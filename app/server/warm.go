@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// minWarmInterval bounds how often a warm name is looked up, however
+	// short the TTL of its answers
+	minWarmInterval = time.Second
+
+	// warmRetryInterval is how long a warm name whose answers could not be
+	// cached waits before it is looked up again
+	warmRetryInterval = 10 * time.Second
+)
+
+// warmAddr is the client and local address warm lookups seem to come from
+var warmAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// WithWarmNames keeps the A and AAAA answers of names in the cache, so
+// lookups of critical dependencies are always cache hits: each is looked up
+// when Listen starts and again in the last tenth of its TTL, as a prefetch
+// would, whether or not clients ask for it. Requires WithCache
+func WithWarmNames(names ...string) Option {
+	return func(s *DNSServer) {
+		s.warmNames = append(s.warmNames, names...)
+	}
+}
+
+// startWarm keeps every warm name refreshed through uncached, the handlers
+// below the cache, until ctx is done. The refreshes count as in flight so
+// Listen waits for them
+func (s *DNSServer) startWarm(ctx context.Context, uncached Handler) {
+	for _, name := range s.warmNames {
+		for _, qt := range []QuestionType{A, AAAA} {
+			q := &Question{Name: name, Type: qt, Class: 1}
+			s.inflight.Add(1)
+			go func() {
+				defer s.inflight.Done()
+				s.keepWarm(ctx, uncached, q)
+			}()
+		}
+	}
+}
+
+// keepWarm looks q up and caches the reply, again each time it is about to
+// expire, until ctx is done
+func (s *DNSServer) keepWarm(ctx context.Context, uncached Handler, q *Question) {
+	for {
+		wait := warmRetryInterval
+		if ttl, ok := s.warm(uncached, q); ok {
+			wait = max(ttl-ttl/prefetchFraction, minWarmInterval)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// warm looks q up once through uncached and caches the reply. Returns how
+// long the reply is cached for, or false if it could not be
+func (s *DNSServer) warm(uncached Handler, q *Question) (ttl time.Duration, ok bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			s.panics.Add(1)
+			fmt.Printf("Recovered panic warming %s %s: %v\n%s", q.Name, q.Type, p, truncatedStack())
+			ttl, ok = 0, false
+		}
+	}()
+
+	w := &prefetchWriter{local: warmAddr, remote: warmAddr, network: "warm"}
+	query := NewQuery(randomID(), q.Name, q.Type, true)
+	uncached.ServeDNS(w, query)
+	if w.reply == nil {
+		return 0, false
+	}
+	return s.cache.store(newCacheKey(q), w.reply, time.Now())
+}
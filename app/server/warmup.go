@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WarmupStep is work that must finish before the server reports itself
+// ready, such as loading data or probing upstreams
+type WarmupStep func(ctx context.Context) error
+
+// WithWarmup registers steps run in order once the socket is bound. The
+// server is not Ready until all of them have finished; a failing step is
+// logged and does not block readiness
+func WithWarmup(steps ...WarmupStep) Option {
+	return func(s *DNSServer) {
+		s.warmup = append(s.warmup, steps...)
+	}
+}
+
+// WithRefuseUntilReady makes the server answer every query with REFUSED
+// until warm-up has finished, so clients fail over quickly instead of getting
+// a burst of SERVFAILs at boot
+func WithRefuseUntilReady(refuse bool) Option {
+	return func(s *DNSServer) {
+		s.refuseUntilReady = refuse
+	}
+}
+
+// Ready reports whether the server is listening and has finished warming up
+func (s *DNSServer) Ready() bool {
+	return s.ready.Load()
+}
+
+// runWarmup runs the warm-up steps and marks the server ready
+func (s *DNSServer) runWarmup(ctx context.Context) {
+	start := time.Now()
+	for i, step := range s.warmup {
+		if err := step(ctx); err != nil {
+			fmt.Printf("Warm-up step %d failed: %v\n", i, err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	if len(s.warmup) > 0 {
+		fmt.Printf("Warm-up finished in %s\n", time.Since(start).Round(time.Millisecond))
+	}
+	s.ready.Store(true)
+}
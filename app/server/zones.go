@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// WithZones limits the static answers to names at or below zones, for which
+// the server is then authoritative (AA set). Queries for other names get an
+// empty NOERROR reply, or REFUSED where WithRefuseOutOfZone applies. Without
+// zones every name is answered. Overrides apply whatever the zone
+func WithZones(zones ...string) Option {
+	return func(s *DNSServer) {
+		for _, zone := range zones {
+			s.zones = append(s.zones, CanonicalName(zone))
+		}
+	}
+}
+
+// WithRefuseOutOfZone answers queries for names outside the zones with
+// REFUSED rather than an empty NOERROR, as a purely authoritative server
+// should. With no addrs it applies to every listener, otherwise only to
+// queries received on the given listen addresses
+func WithRefuseOutOfZone(addrs ...*net.UDPAddr) Option {
+	return func(s *DNSServer) {
+		if len(addrs) == 0 {
+			s.refuseOutOfZoneAll = true
+		}
+		s.refuseOutOfZone = append(s.refuseOutOfZone, addrs...)
+	}
+}
+
+// inZone reports whether name is at or below one of the server's zones
+func (s *DNSServer) inZone(name string) bool {
+	if len(s.zones) == 0 {
+		return true
+	}
+	name = CanonicalName(name)
+	for _, zone := range s.zones {
+		if zone == "" || name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// refusesOutOfZone reports whether out-of-zone queries received on local are
+// refused
+func (s *DNSServer) refusesOutOfZone(local net.Addr) bool {
+	if s.refuseOutOfZoneAll {
+		return true
+	}
+	for _, addr := range s.refuseOutOfZone {
+		if listenerMatches(addr, local) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerMatches reports whether local, the address a query arrived on, is
+// served by the listen address addr. Sockets bound to a wildcard address
+// report it for UDP but the actual destination for TCP, so a wildcard matches
+// any IP on its port
+func listenerMatches(addr *net.UDPAddr, local net.Addr) bool {
+	host, port, err := net.SplitHostPort(local.String())
+	if err != nil || port != strconv.Itoa(addr.Port) {
+		return false
+	}
+	return addr.IP == nil || addr.IP.IsUnspecified() || addr.IP.Equal(net.ParseIP(host))
+}